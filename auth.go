@@ -0,0 +1,80 @@
+package vcd
+
+import (
+	"fmt"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+const (
+	authMethodToken          = "token"
+	authMethodPassword       = "password"
+	authMethodSystem         = "system"
+	authMethodServiceAccount = "service_account"
+
+	systemOrg = "System"
+)
+
+// authenticator logs a new VCD client in.
+type authenticator interface {
+	authenticate(client *govcd.VCDClient) error
+}
+
+// tokenAuthenticator exchanges an API token (VCD 10.4+) for a bearer token.
+type tokenAuthenticator struct {
+	org   string
+	token *secret
+}
+
+func (a *tokenAuthenticator) authenticate(client *govcd.VCDClient) error {
+	token, err := a.token.get()
+	if err != nil {
+		return err
+	}
+
+	return client.SetToken(a.org, govcd.ApiTokenHeader, token)
+}
+
+// passwordAuthenticator logs in with a local user, either of the tenant org
+// or of the System org.
+type passwordAuthenticator struct {
+	org      string
+	username string
+	password *secret
+}
+
+func (a *passwordAuthenticator) authenticate(client *govcd.VCDClient) error {
+	password, err := a.password.get()
+	if err != nil {
+		return err
+	}
+
+	return client.Authenticate(a.username, password, a.org)
+}
+
+// serviceAccountAuthenticator exchanges the refresh token of a service account
+// for a bearer token. Service account refresh tokens are single use, so the
+// rotated one is written back to the file for the next authentication.
+type serviceAccountAuthenticator struct {
+	org       string
+	tokenFile string
+}
+
+func (a *serviceAccountAuthenticator) authenticate(client *govcd.VCDClient) error {
+	return client.SetServiceAccountApiToken(a.org, a.tokenFile)
+}
+
+func (g *InstanceGroup) newAuthenticator() (authenticator, error) {
+	switch g.AuthMethod {
+	case authMethodToken:
+		return &tokenAuthenticator{org: g.Org, token: g.token}, nil
+	case authMethodPassword:
+		return &passwordAuthenticator{org: g.Org, username: g.Username, password: g.password}, nil
+	case authMethodSystem:
+		return &passwordAuthenticator{org: systemOrg, username: g.Username, password: g.password}, nil
+	case authMethodServiceAccount:
+		return &serviceAccountAuthenticator{org: g.Org, tokenFile: g.ServiceAccountTokenFile}, nil
+	}
+
+	return nil, fmt.Errorf("invalid auth_method: %s", g.AuthMethod)
+}
@@ -0,0 +1,299 @@
+package vcd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// vcdResources holds the VCD objects the plugin looks up by name, so that
+// provisioning a VM only costs the calls that actually change state.
+// It is never modified once resolved: a new one replaces it when refreshed.
+type vcdResources struct {
+	client *govcd.VCDClient // the objects below are bound to the client that resolved them
+
+	org        *govcd.Org
+	placements map[string]*placementResources
+
+	resolvedAt time.Time
+}
+
+// placementResources holds the VCD objects of a placement.
+type placementResources struct {
+	vdc             *govcd.Vdc
+	network         *types.OrgVDCNetwork
+	placementPolicy *types.VdcComputePolicy
+	flavors         map[string]*flavorResources
+
+	err error // why the placement can not be used, if it can not
+}
+
+// flavorResources holds the VCD objects a flavor is provisioned from.
+type flavorResources struct {
+	template        govcd.VAppTemplate
+	templateVersion int64
+	sourceVM        *types.Reference // cloned instead of deploying the template, if set
+	storageProfile  *types.Reference
+	sizingPolicy    *types.VdcComputePolicy
+
+	err error // why the flavor can not be provisioned, if it can not
+}
+
+// VDC returns a copy of the cached VDC, as some govcd methods refresh it in place.
+func (r *placementResources) VDC() *govcd.Vdc {
+	vdc := *r.vdc
+	return &vdc
+}
+
+// getResources returns the cached VCD resources, resolving them again
+// when the cache has expired or the client has re-authenticated.
+func (g *InstanceGroup) getResources() (*vcdResources, error) {
+	client, err := g.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	g.resourcesMu.Lock()
+	defer g.resourcesMu.Unlock()
+
+	cached := g.resources
+	if cached != nil && cached.client == client && time.Since(cached.resolvedAt) < time.Duration(g.CacheTTL) {
+		return cached, nil
+	}
+
+	resources, err := g.resolveResources(client)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil {
+		g.logTemplateVersionChanges(cached, resources)
+	}
+
+	g.resources = resources
+
+	return resources, nil
+}
+
+// forgetResourcesIfNotFound drops the cached resources when err tells that
+// one of them no longer exists in VCD, so they are resolved again next time.
+func (g *InstanceGroup) forgetResourcesIfNotFound(err error) {
+	if !isNotFound(err) {
+		return
+	}
+
+	g.resourcesMu.Lock()
+	defer g.resourcesMu.Unlock()
+
+	g.resources = nil
+}
+
+// logTemplateVersionChanges logs the flavors whose template has a new version.
+func (g *InstanceGroup) logTemplateVersionChanges(cached, resources *vcdResources) {
+	for _, flavor := range g.flavors {
+		for _, placement := range g.placements {
+			previous, current := cached.placements[placement.Name], resources.placements[placement.Name]
+			if previous.err != nil || current.err != nil {
+				continue
+			}
+
+			previousFlavor, currentFlavor := previous.flavors[flavor.Name], current.flavors[flavor.Name]
+			if previousFlavor.err == nil && currentFlavor.err == nil && previousFlavor.templateVersion != currentFlavor.templateVersion {
+				g.log.Info("template version changed", "flavor", flavor.Name, "template", flavor.Template, "old", previousFlavor.templateVersion, "new", currentFlavor.templateVersion)
+				break
+			}
+		}
+	}
+}
+
+func (g *InstanceGroup) resolveResources(client *govcd.VCDClient) (*vcdResources, error) {
+	org, err := client.GetOrgByName(g.Org)
+	if err != nil {
+		return nil, fmt.Errorf("getting org %s: %w", g.Org, err)
+	}
+
+	var catalog *govcd.Catalog
+	if g.Catalog != "" {
+		catalog, err = org.GetCatalogByName(g.Catalog, false)
+		if err != nil {
+			return nil, fmt.Errorf("getting catalog %s: %w", g.Catalog, err)
+		}
+	}
+
+	var adminOrg *govcd.AdminOrg
+	if g.FastProvisioning {
+		adminOrg, err = client.GetAdminOrgByName(g.Org)
+		if err != nil {
+			return nil, fmt.Errorf("getting admin org %s: %w", g.Org, err)
+		}
+	}
+
+	// the templates are shared by all placements, the source VMs are looked up in each of them
+	templates := map[string]*flavorResources{}
+	for _, flavor := range g.flavors {
+		if flavor.Template == "" {
+			templates[flavor.Name] = &flavorResources{}
+			continue
+		}
+		templates[flavor.Name] = resolveTemplate(catalog, flavor.Template)
+	}
+
+	// a placement or flavor that can not be resolved is only unavailable, unless all of them are
+	placements := map[string]*placementResources{}
+	errs := []error{}
+	for _, placement := range g.placements {
+		resources := g.resolvePlacement(client, org, adminOrg, templates, placement)
+		if resources.err != nil {
+			if len(g.placements) > 1 {
+				resources.err = fmt.Errorf("placement %s: %w", placement.Name, resources.err)
+				g.log.Error("placement unavailable", "placement", placement.Name, "error", resources.err)
+			}
+			errs = append(errs, resources.err)
+		}
+		placements[placement.Name] = resources
+	}
+
+	if len(errs) == len(g.placements) {
+		return nil, errors.Join(errs...)
+	}
+
+	return &vcdResources{
+		client:     client,
+		org:        org,
+		placements: placements,
+		resolvedAt: time.Now(),
+	}, nil
+}
+
+// resolvePlacement looks up the VDC, network and policies of a placement, and the
+// storage profiles and sizing policies of the flavors in its VDC.
+func (g *InstanceGroup) resolvePlacement(client *govcd.VCDClient, org *govcd.Org, adminOrg *govcd.AdminOrg, templates map[string]*flavorResources, p *Placement) *placementResources {
+	vdc, err := org.GetVDCByName(p.VirtualDatacenter, false)
+	if err != nil {
+		return &placementResources{err: fmt.Errorf("getting VDC %s: %w", p.VirtualDatacenter, err)}
+	}
+
+	if adminOrg != nil {
+		if err := checkFastProvisioning(adminOrg, p.VirtualDatacenter); err != nil {
+			return &placementResources{err: err}
+		}
+	}
+
+	network, err := vdc.GetOrgVdcNetworkByName(p.Network, false)
+	if err != nil {
+		return &placementResources{err: fmt.Errorf("getting network %s: %w", p.Network, err)}
+	}
+
+	policies, err := g.getAssignedComputePolicies(client, vdc)
+	if err != nil {
+		return &placementResources{err: err}
+	}
+
+	var placement *types.VdcComputePolicy
+	if g.PlacementPolicy != "" {
+		placement, err = findComputePolicy(policies, g.PlacementPolicy, placementPolicy)
+		if err != nil {
+			return &placementResources{err: err}
+		}
+	}
+
+	// a flavor that can not be resolved is only unavailable, unless all of them are
+	flavors := map[string]*flavorResources{}
+	errs := []error{}
+	for _, flavor := range g.flavors {
+		resources := g.resolveFlavor(vdc, templates[flavor.Name], policies, p, flavor)
+		if resources.err != nil {
+			if len(g.flavors) > 1 {
+				resources.err = fmt.Errorf("flavor %s: %w", flavor.Name, resources.err)
+				g.log.Error("flavor unavailable", "placement", p.Name, "flavor", flavor.Name, "error", resources.err)
+			}
+			errs = append(errs, resources.err)
+		}
+		flavors[flavor.Name] = resources
+	}
+
+	if len(errs) == len(g.flavors) {
+		return &placementResources{err: errors.Join(errs...)}
+	}
+
+	return &placementResources{
+		vdc:             vdc,
+		network:         network.OrgVDCNetwork,
+		placementPolicy: placement,
+		flavors:         flavors,
+	}
+}
+
+// resolveTemplate looks up a template in the catalog.
+func resolveTemplate(catalog *govcd.Catalog, name string) *flavorResources {
+	catalogItem, err := catalog.GetCatalogItemByName(name, true)
+	if err != nil {
+		return &flavorResources{err: fmt.Errorf("getting template %s: %w", name, err)}
+	}
+
+	template, err := catalogItem.GetVAppTemplate()
+	if err != nil {
+		return &flavorResources{err: fmt.Errorf("getting vApp template %s: %w", name, err)}
+	}
+
+	return &flavorResources{
+		template:        template,
+		templateVersion: catalogItem.CatalogItem.VersionNumber,
+	}
+}
+
+// resolveFlavor looks up the source VM, storage profile and sizing policy of a flavor in the VDC
+// of a placement, completing its resolved template.
+func (g *InstanceGroup) resolveFlavor(vdc *govcd.Vdc, template *flavorResources, policies []*types.VdcComputePolicyV2, p *Placement, flavor *Flavor) *flavorResources {
+	if template.err != nil {
+		return template
+	}
+
+	var sourceVM *types.Reference
+	if flavor.SourceVM != "" {
+		var err error
+		sourceVM, err = resolveSourceVM(vdc, flavor)
+		if err != nil {
+			return &flavorResources{err: err}
+		}
+	}
+
+	name := flavor.StorageProfile
+	if name == "" {
+		name = p.StorageProfile
+	}
+
+	var storageProfile *types.Reference
+	if name != "" {
+		reference, err := vdc.FindStorageProfileReference(name)
+		if err != nil {
+			return &flavorResources{err: fmt.Errorf("getting storage profile %s: %w", name, err)}
+		}
+		storageProfile = &reference
+	}
+
+	var sizing *types.VdcComputePolicy
+	if flavor.SizingPolicy != "" {
+		var err error
+		sizing, err = findComputePolicy(policies, flavor.SizingPolicy, sizingPolicy)
+		if err != nil {
+			return &flavorResources{err: err}
+		}
+	}
+
+	return &flavorResources{
+		template:        template.template,
+		templateVersion: template.templateVersion,
+		sourceVM:        sourceVM,
+		storageProfile:  storageProfile,
+		sizingPolicy:    sizing,
+	}
+}
+
+func isNotFound(err error) bool {
+	return err != nil && (govcd.ContainsNotFound(err) || strings.Contains(err.Error(), "API Error: 404"))
+}
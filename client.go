@@ -0,0 +1,216 @@
+package vcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+// getClient returns the long-lived VCD client shared by all operations,
+// authenticating again when there is none yet or its session has expired.
+// Objects obtained from an expired client keep working until VCD rejects
+// them, so callers should get a client for every operation instead of storing it.
+func (g *InstanceGroup) getClient() (*govcd.VCDClient, error) {
+	g.clientMu.Lock()
+	defer g.clientMu.Unlock()
+
+	if g.vcdClient != nil && !sessionExpired(g.vcdClient) {
+		return g.vcdClient, nil
+	}
+
+	if g.vcdClient != nil {
+		g.log.Info("VCD session expired, authenticating again")
+	}
+
+	return g.login()
+}
+
+// renewClient returns the client to retry a request with after VCD rejected the
+// session of the given one, authenticating again unless it was already replaced.
+func (g *InstanceGroup) renewClient(rejected *govcd.VCDClient) (*govcd.VCDClient, error) {
+	g.clientMu.Lock()
+	defer g.clientMu.Unlock()
+
+	if g.vcdClient != nil && g.vcdClient != rejected && !sessionExpired(g.vcdClient) {
+		return g.vcdClient, nil
+	}
+
+	g.log.Info("VCD session expired, authenticating again")
+
+	return g.login()
+}
+
+// login replaces the shared client with a newly authenticated one. clientMu must be held.
+func (g *InstanceGroup) login() (*govcd.VCDClient, error) {
+	client, err := newClient(*g.parsedURL, g.Org, g.APIVersion, g.authenticator, g.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// only once authenticated, so that a failed login is not retried
+	if transport, ok := client.Client.Http.Transport.(*sessionTransport); ok {
+		transport.renew = func() (*govcd.Client, error) {
+			renewed, err := g.renewClient(client)
+			if err != nil {
+				return nil, err
+			}
+			return &renewed.Client, nil
+		}
+	}
+
+	g.vcdClient = client
+
+	return client, nil
+}
+
+// authHeaders are the headers govcd authenticates its requests with.
+var authHeaders = []string{"x-vcloud-authorization", govcd.BearerTokenHeader, "X-Vmware-Vcloud-Token-Type"}
+
+// sessionTransport flags the session of a client as expired as soon as VCD
+// answers a request with 401 Unauthorized. When it can renew the session, the
+// request is then retried once with the new one, provided its body can be replayed.
+type sessionTransport struct {
+	http.RoundTripper
+	expired atomic.Bool
+
+	renew func() (*govcd.Client, error)
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	t.expired.Store(true)
+
+	if t.renew == nil || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	client, err := t.renew()
+	if err != nil {
+		// the caller gets the original 401, with the renewal left to the next getClient
+		return resp, nil
+	}
+
+	retry, err := reauthorizeRequest(req, client)
+	if err != nil {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	return t.RoundTripper.RoundTrip(retry)
+}
+
+// reauthorizeRequest returns a copy of the request, with its body rewound and the
+// authentication headers of the client in place of the rejected ones.
+func reauthorizeRequest(req *http.Request, client *govcd.Client) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+
+	for _, header := range authHeaders {
+		retry.Header.Del(header)
+	}
+	if strings.HasPrefix(strings.ToLower(retry.Header.Get("Authorization")), "bearer ") {
+		retry.Header.Del("Authorization")
+	}
+
+	// as set by govcd on every request
+	if client.VCDAuthHeader != "" && client.VCDToken != "" {
+		retry.Header.Add(client.VCDAuthHeader, client.VCDToken)
+	}
+	if len(client.VCDToken) > 32 {
+		retry.Header.Add("X-Vmware-Vcloud-Token-Type", "Bearer")
+		retry.Header.Add("Authorization", "bearer "+client.VCDToken)
+	}
+
+	return retry, nil
+}
+
+func sessionExpired(client *govcd.VCDClient) bool {
+	transport, ok := client.Client.Http.Transport.(*sessionTransport)
+	return ok && transport.expired.Load()
+}
+
+// buildTLSConfig returns the TLS settings used to talk to the VCD API.
+func (g *InstanceGroup) buildTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         g.TLSServerName,
+		InsecureSkipVerify: g.InsecureSkipVerify,
+	}
+
+	if g.CAFile != "" || g.CAPEM != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		caPEM := []byte(g.CAPEM)
+		if g.CAFile != "" {
+			caPEM, err = os.ReadFile(g.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading ca_file: %w", err)
+			}
+		}
+
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates found in CA bundle")
+		}
+
+		config.RootCAs = pool
+	}
+
+	if g.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(g.ClientCertFile, g.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func newClient(apiURL url.URL, org string, apiVersion string, auth authenticator, tlsConfig *tls.Config) (*govcd.VCDClient, error) {
+	client := &govcd.VCDClient{
+		Client: govcd.Client{
+			VCDHREF:    apiURL,
+			APIVersion: apiVersion,
+			Http: http.Client{
+				Transport: &sessionTransport{
+					RoundTripper: &http.Transport{
+						TLSClientConfig:     tlsConfig,
+						Proxy:               http.ProxyFromEnvironment,
+						TLSHandshakeTimeout: 120 * time.Second,
+					},
+				},
+				Timeout: 600 * time.Second,
+			},
+			MaxRetryTimeout: 60,
+		},
+	}
+
+	err := auth.authenticate(client)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authenticate to Org \"%s\": %s", org, err)
+	}
+	return client, nil
+}
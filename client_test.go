@@ -0,0 +1,108 @@
+package vcd
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+func TestSessionTransport(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	transport := &sessionTransport{RoundTripper: http.DefaultTransport}
+	client := &govcd.VCDClient{Client: govcd.Client{Http: http.Client{Transport: transport}}}
+
+	resp, err := client.Client.Http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.False(t, sessionExpired(client))
+
+	status = http.StatusUnauthorized
+	resp, err = client.Client.Http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.True(t, sessionExpired(client))
+}
+
+func TestSessionTransportRetry(t *testing.T) {
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("x-vcloud-authorization") != "renewed" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	renewals := 0
+	transport := &sessionTransport{
+		RoundTripper: http.DefaultTransport,
+		renew: func() (*govcd.Client, error) {
+			renewals++
+			return &govcd.Client{VCDAuthHeader: "x-vcloud-authorization", VCDToken: "renewed"}, nil
+		},
+	}
+	client := http.Client{Transport: transport}
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("params"))
+	require.NoError(t, err)
+	req.Header.Set("x-vcloud-authorization", "expired")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, renewals)
+	require.Equal(t, []string{"params", "params"}, bodies)
+
+	// a body that can not be replayed is not sent again
+	bodies = nil
+	req, err = http.NewRequest(http.MethodPost, server.URL, io.NopCloser(strings.NewReader("params")))
+	require.NoError(t, err)
+	req.Header.Set("x-vcloud-authorization", "expired")
+
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, 1, renewals)
+	require.Equal(t, []string{"params"}, bodies)
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	g := &InstanceGroup{
+		CAPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+	}
+	config, err := g.buildTLSConfig()
+	require.NoError(t, err)
+
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	g = &InstanceGroup{TLSServerName: "vcd.example.com", InsecureSkipVerify: true}
+	config, err = g.buildTLSConfig()
+	require.NoError(t, err)
+	require.Equal(t, "vcd.example.com", config.ServerName)
+	require.True(t, config.InsecureSkipVerify)
+	require.Nil(t, config.RootCAs)
+
+	g = &InstanceGroup{CAPEM: "not a certificate"}
+	_, err = g.buildTLSConfig()
+	require.Error(t, err)
+}
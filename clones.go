@@ -0,0 +1,102 @@
+package vcd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// cloneVM adds a VM to the vApp, deployed from the template of the flavor or cloned from its source VM.
+// In a VDC using fast provisioning, VCD makes it a linked clone sharing the disks of its source.
+func (g *InstanceGroup) cloneVM(client *govcd.VCDClient, vapp *govcd.VApp, name string, resources *flavorResources, netSection *types.NetworkConnectionSection) (govcd.Task, error) {
+	if resources.sourceVM == nil {
+		return vapp.AddNewVMWithComputePolicy(
+			name,
+			resources.template,
+			netSection,               // network
+			resources.storageProfile, // storage
+			resources.sizingPolicy,   // compute policy, the placement policy is set by setupVM
+			true,
+		)
+	}
+
+	// like AddNewVMWithComputePolicy, with a VM as the source of the recomposition
+	params := &types.ReComposeVAppParams{
+		Ovf:         types.XMLNamespaceOVF,
+		Xsi:         types.XMLNamespaceXSI,
+		Xmlns:       types.XMLNamespaceVCloud,
+		Name:        vapp.VApp.Name,
+		Description: vapp.VApp.Description,
+		SourcedItem: &types.SourcedCompositionItemParam{
+			Source: &types.Reference{
+				HREF: resources.sourceVM.HREF,
+				Name: name,
+			},
+			VMGeneralParams: &types.VMGeneralParams{
+				Name:               name,
+				NeedsCustomization: true,
+				RegenerateBiosUuid: true,
+			},
+			InstantiationParams: &types.InstantiationParams{
+				NetworkConnectionSection: netSection,
+			},
+			StorageProfile: resources.storageProfile,
+		},
+		AllEULAsAccepted: true,
+	}
+
+	if resources.sizingPolicy != nil {
+		href, err := client.Client.OpenApiBuildEndpoint(types.OpenApiPathVersion1_0_0, types.OpenApiEndpointVdcComputePolicies, resources.sizingPolicy.ID)
+		if err != nil {
+			return govcd.Task{}, fmt.Errorf("building HREF of sizing policy %s: %w", resources.sizingPolicy.Name, err)
+		}
+		params.SourcedItem.ComputePolicy = &types.ComputePolicy{VmSizingPolicy: &types.Reference{HREF: href.String()}}
+	}
+
+	endpoint, err := url.ParseRequestURI(vapp.VApp.HREF)
+	if err != nil {
+		return govcd.Task{}, err
+	}
+	endpoint.Path += "/action/recomposeVApp"
+
+	return client.Client.ExecuteTaskRequest(endpoint.String(), http.MethodPost,
+		types.MimeRecomposeVappParams, "error cloning VM: %s", params)
+}
+
+// resolveSourceVM looks up the powered-off VM a flavor is cloned from, in the VDC of a placement.
+func resolveSourceVM(vdc *govcd.Vdc, flavor *Flavor) (*types.Reference, error) {
+	vapp, err := vdc.GetVAppByName(flavor.SourceVApp, false)
+	if err != nil {
+		return nil, fmt.Errorf("getting source vApp %s: %w", flavor.SourceVApp, err)
+	}
+
+	vm, err := vapp.GetVMByName(flavor.SourceVM, false)
+	if err != nil {
+		return nil, fmt.Errorf("getting source VM %s: %w", flavor.SourceVM, err)
+	}
+
+	// VCD can only make linked clones of a powered-off VM
+	if status := types.VAppStatuses[vm.VM.Status]; status != "POWERED_OFF" {
+		return nil, fmt.Errorf("source VM %s must be powered off, it is %s", flavor.SourceVM, status)
+	}
+
+	return &types.Reference{HREF: vm.VM.HREF, Name: vm.VM.Name}, nil
+}
+
+// checkFastProvisioning makes sure a VDC uses fast provisioning, which reading
+// through the admin API requires the right to view the VDC.
+func checkFastProvisioning(adminOrg *govcd.AdminOrg, name string) error {
+	vdc, err := adminOrg.GetAdminVDCByName(name, false)
+	if err != nil {
+		return fmt.Errorf("checking fast provisioning of VDC %s: %w", name, err)
+	}
+
+	if vdc.AdminVdc.UsesFastProvisioning == nil || !*vdc.AdminVdc.UsesFastProvisioning {
+		return fmt.Errorf("VDC %s does not use fast provisioning", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package vcd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestCloneVMFromSourceVM(t *testing.T) {
+	var params types.ReComposeVAppParams
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/vApp/vapp-1/action/recomposeVApp":
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, xml.Unmarshal(body, &params))
+			w.WriteHeader(http.StatusAccepted)
+			writeTestTask(w, r, "running")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	vapp := govcd.NewVApp(&client.Client)
+	vapp.VApp.HREF = serverURL + "/api/vApp/vapp-1"
+	vapp.VApp.Name = "runners"
+
+	resources := &flavorResources{
+		sourceVM:     &types.Reference{HREF: serverURL + "/api/vApp/vm-golden", Name: "golden"},
+		sizingPolicy: &types.VdcComputePolicy{ID: "urn:vcloud:vdcComputePolicy:small", Name: "small"},
+	}
+
+	g := &InstanceGroup{}
+	_, err := g.cloneVM(client, vapp, "runner-abcd1234", resources, &types.NetworkConnectionSection{})
+	require.NoError(t, err)
+
+	item := params.SourcedItem
+	require.NotNil(t, item)
+	require.Equal(t, "runners", params.Name)
+	require.Equal(t, serverURL+"/api/vApp/vm-golden", item.Source.HREF)
+	require.Equal(t, "runner-abcd1234", item.Source.Name)
+	require.Equal(t, "runner-abcd1234", item.VMGeneralParams.Name)
+	require.True(t, item.VMGeneralParams.NeedsCustomization)
+	require.True(t, item.VMGeneralParams.RegenerateBiosUuid)
+	require.Equal(t, serverURL+"/cloudapi/1.0.0/vdcComputePolicies/urn:vcloud:vdcComputePolicy:small", item.ComputePolicy.VmSizingPolicy.HREF)
+}
+
+func TestResolveSourceVM(t *testing.T) {
+	status := 8
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/versions":
+			fmt.Fprint(w, `<SupportedVersions xmlns="http://www.vmware.com/vcloud/versions"><VersionInfo deprecated="false"><Version>37.3</Version></VersionInfo></SupportedVersions>`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/vApp/vapp-golden":
+			w.Header().Set("Content-Type", types.MimeVApp)
+			fmt.Fprintf(w, `<VApp xmlns="http://www.vmware.com/vcloud/v1.5" href="http://%[1]s/api/vApp/vapp-golden" name="golden"><Children><Vm href="http://%[1]s/api/vApp/vm-golden" name="golden"/></Children></VApp>`, r.Host)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/vApp/vm-golden":
+			w.Header().Set("Content-Type", types.MimeVM)
+			fmt.Fprintf(w, `<Vm xmlns="http://www.vmware.com/vcloud/v1.5" href="http://%s/api/vApp/vm-golden" name="golden" status="%d"/>`, r.Host, status)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	// fetches the supported versions, which looking VMs up depends on
+	require.True(t, client.Client.APIVCDMaxVersionIs(">= 37.0"))
+
+	vdc := govcd.NewVdc(&client.Client)
+	vdc.Vdc.ResourceEntities = []*types.ResourceEntities{{ResourceEntity: []*types.ResourceReference{
+		{HREF: serverURL + "/api/vApp/vapp-golden", Name: "golden", Type: types.MimeVApp},
+	}}}
+	flavor := &Flavor{SourceVApp: "golden", SourceVM: "golden"}
+
+	ref, err := resolveSourceVM(vdc, flavor)
+	require.NoError(t, err)
+	require.Equal(t, &types.Reference{HREF: serverURL + "/api/vApp/vm-golden", Name: "golden"}, ref)
+
+	// linked clones can only be made of a powered-off VM
+	status = 4
+	_, err = resolveSourceVM(vdc, flavor)
+	require.EqualError(t, err, "source VM golden must be powered off, it is POWERED_ON")
+}
+
+func TestCheckFastProvisioning(t *testing.T) {
+	fastProvisioning := true
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/admin/vdc/vdc-1":
+			w.Header().Set("Content-Type", types.MimeAdminVDC)
+			fmt.Fprintf(w, `<AdminVdc xmlns="http://www.vmware.com/vcloud/v1.5" name="vdc1"><UsesFastProvisioning>%t</UsesFastProvisioning></AdminVdc>`, fastProvisioning)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	adminOrg := govcd.NewAdminOrg(&client.Client)
+	adminOrg.AdminOrg.Vdcs = &types.VDCList{Vdcs: []*types.Reference{{HREF: serverURL + "/api/admin/vdc/vdc-1", Name: "vdc1"}}}
+
+	require.NoError(t, checkFastProvisioning(adminOrg, "vdc1"))
+
+	fastProvisioning = false
+	require.EqualError(t, checkFastProvisioning(adminOrg, "vdc1"), "VDC vdc1 does not use fast provisioning")
+
+	require.ErrorContains(t, checkFastProvisioning(adminOrg, "vdc2"), "checking fast provisioning of VDC vdc2")
+}
@@ -0,0 +1,87 @@
+package vcd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// OVF properties read by cloud-init's OVF datasource
+const (
+	ovfPropertyUserData   = "user-data"
+	ovfPropertyInstanceID = "instance-id"
+	ovfPropertyHostname   = "hostname"
+)
+
+// loadUserData parses the cloud-init user-data template, either inline or from a file.
+func (g *InstanceGroup) loadUserData() error {
+	userData := g.UserData
+	if g.UserDataFile != "" {
+		content, err := os.ReadFile(g.UserDataFile)
+		if err != nil {
+			return fmt.Errorf("reading user_data_file: %w", err)
+		}
+		userData = string(content)
+	}
+
+	if userData == "" {
+		return nil
+	}
+
+	templ, err := template.New("user-data").Parse(userData)
+	if err != nil {
+		return fmt.Errorf("parsing user_data: %w", err)
+	}
+
+	g.userData = templ
+
+	return nil
+}
+
+// injectUserData renders the user-data template for the VM and passes it,
+// base64 encoded, as OVF properties so cloud-init can pick it up on boot.
+func (g *InstanceGroup) injectUserData(vm *govcd.VM, data guestTemplateData) error {
+	var userData bytes.Buffer
+	if err := g.userData.Execute(&userData, data); err != nil {
+		return fmt.Errorf("rendering user_data: %w", err)
+	}
+
+	productSection, err := vm.GetProductSectionList()
+	if err != nil {
+		return err
+	}
+
+	if productSection.ProductSection == nil {
+		productSection.ProductSection = &types.ProductSection{}
+	}
+
+	setOVFProperty(productSection.ProductSection, ovfPropertyUserData, base64.StdEncoding.EncodeToString(userData.Bytes()))
+	setOVFProperty(productSection.ProductSection, ovfPropertyInstanceID, data.InstanceName)
+	setOVFProperty(productSection.ProductSection, ovfPropertyHostname, data.InstanceName)
+
+	_, err = vm.SetProductSectionList(productSection)
+	return err
+}
+
+// setOVFProperty sets the value of an OVF property, adding it if it is not
+// already defined by the template.
+func setOVFProperty(section *types.ProductSection, key string, value string) {
+	for _, property := range section.Property {
+		if property.Key == key {
+			property.Value = &types.Value{Value: value}
+			return
+		}
+	}
+
+	section.Property = append(section.Property, &types.Property{
+		Key:              key,
+		Type:             "string",
+		UserConfigurable: true,
+		Value:            &types.Value{Value: value},
+	})
+}
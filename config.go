@@ -1,13 +1,47 @@
 package vcd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"path/filepath"
+	"time"
 
 	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
 )
 
+// Duration is a time.Duration that can be set in the plugin config
+// as a string like "5m", as well as a number of nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value any
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", b)
+	}
+
+	return nil
+}
+
 func (g *InstanceGroup) validate() error {
 	errs := []error{}
 
@@ -16,13 +50,101 @@ func (g *InstanceGroup) validate() error {
 		g.settings.Protocol = provider.ProtocolSSH
 	}
 
+	if g.Protocol == "" {
+		g.Protocol = string(g.settings.Protocol)
+	}
+
+	if g.AuthMethod == "" {
+		g.AuthMethod = authMethodToken
+	}
+
+	g.token = newSecret("token", g.Token, g.TokenFile, g.TokenEnv)
+	g.password = newSecret("password", g.Password, g.PasswordFile, g.PasswordEnv)
+	g.staticPassword = newSecret("static_password", g.settings.Password, g.StaticPasswordFile, g.StaticPasswordEnv)
+
+	if g.APIVersion == "" {
+		g.APIVersion = "37.3"
+	}
+
+	if g.DynamicCredentials == "" {
+		g.DynamicCredentials = dynamicCredentialsKey
+	}
+
+	if g.KeyStoreDir == "" && !g.settings.UseStaticCredentials && g.DynamicCredentials == dynamicCredentialsKey && !g.StoreKeysInMetadata {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("missing key_store_dir: %w", err))
+		} else {
+			g.KeyStoreDir = filepath.Join(configDir, "fleeting-plugin-vcd", "keys", url.PathEscape(g.Name))
+		}
+	}
+
+	if g.PreDeleteTimeout == 0 {
+		g.PreDeleteTimeout = Duration(5 * time.Minute)
+	}
+
+	if g.DeleteOnShutdown == "" {
+		g.DeleteOnShutdown = deleteOnShutdownIfCreated
+	}
+
+	if g.CacheTTL == 0 {
+		g.CacheTTL = Duration(5 * time.Minute)
+	}
+
+	if g.BootTimeout == 0 {
+		g.BootTimeout = Duration(10 * time.Minute)
+	}
+
+	if g.GCInterval == 0 {
+		g.GCInterval = Duration(5 * time.Minute)
+	}
+
+	if g.GCGracePeriod == 0 {
+		g.GCGracePeriod = Duration(30 * time.Minute)
+	}
+
+	if g.MaxParallelism == 0 {
+		g.MaxParallelism = 4
+	}
+
+	if g.WarmPoolInterval == 0 {
+		g.WarmPoolInterval = Duration(time.Minute)
+	}
+
+	if g.PlacementStrategy == "" {
+		g.PlacementStrategy = placementSpread
+	}
+
+	if g.FailoverCooldown == 0 {
+		g.FailoverCooldown = Duration(5 * time.Minute)
+	}
+
 	// Checks
 	if g.Name == "" {
 		errs = append(errs, fmt.Errorf("missing required plugin config: name"))
 	}
 
-	if g.Token == "" {
-		errs = append(errs, fmt.Errorf("missing required plugin config: token"))
+	for _, secret := range []*secret{g.token, g.password, g.staticPassword} {
+		if err := secret.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch g.AuthMethod {
+	case authMethodToken:
+		if !g.token.isSet() {
+			errs = append(errs, fmt.Errorf("missing required plugin config: token"))
+		}
+	case authMethodPassword, authMethodSystem:
+		if g.Username == "" || !g.password.isSet() {
+			errs = append(errs, fmt.Errorf("missing required plugin config: username and password"))
+		}
+	case authMethodServiceAccount:
+		if g.ServiceAccountTokenFile == "" {
+			errs = append(errs, fmt.Errorf("missing required plugin config: service_account_token_file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid auth_method: %s", g.AuthMethod))
 	}
 
 	if g.StrURL == "" {
@@ -38,14 +160,6 @@ func (g *InstanceGroup) validate() error {
 		errs = append(errs, fmt.Errorf("missing required plugin config: org"))
 	}
 
-	if g.VirtualDatacenter == "" {
-		errs = append(errs, fmt.Errorf("missing required plugin config: virtual_datacenter"))
-	}
-
-	if g.Network == "" {
-		errs = append(errs, fmt.Errorf("missing required plugin config: network"))
-	}
-
 	if g.IPAllocationMode == "" {
 		errs = append(errs, fmt.Errorf("missing required plugin config: ip_allocation_mode"))
 	}
@@ -54,24 +168,92 @@ func (g *InstanceGroup) validate() error {
 		errs = append(errs, fmt.Errorf("invalid ip_allocation_mode: %s", g.IPAllocationMode))
 	}
 
-	if g.Catalog == "" {
+	g.flavors = g.resolveFlavors()
+	errs = append(errs, g.validateFlavors()...)
+
+	if g.Catalog == "" && g.usesTemplates() {
 		errs = append(errs, fmt.Errorf("missing required plugin config: catalog"))
 	}
 
-	if g.Template == "" {
-		errs = append(errs, fmt.Errorf("missing required plugin config: template"))
+	errs = append(errs, g.validateAllocations()...)
+
+	g.placements = g.resolvePlacements()
+	errs = append(errs, g.validatePlacements()...)
+
+	if g.CAFile != "" && g.CAPEM != "" {
+		errs = append(errs, fmt.Errorf("ca_file and ca_pem are mutually exclusive"))
+	}
+
+	if (g.ClientCertFile == "") != (g.ClientKeyFile == "") {
+		errs = append(errs, fmt.Errorf("client_cert_file and client_key_file must be set together"))
+	}
+
+	if g.CacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("invalid cache_ttl: %s", time.Duration(g.CacheTTL)))
+	}
+
+	if g.BootTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid boot_timeout: %s", time.Duration(g.BootTimeout)))
+	}
+
+	if g.WarmPoolSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid warm_pool_size: %d", g.WarmPoolSize))
+	}
+
+	if g.WarmPoolInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid warm_pool_interval: %s", time.Duration(g.WarmPoolInterval)))
+	}
+
+	if g.GCInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid gc_interval: %s", time.Duration(g.GCInterval)))
 	}
 
-	if g.CPUCount == 0 {
-		errs = append(errs, fmt.Errorf("missing required plugin config: cpu_count"))
+	if g.GCGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("invalid gc_grace_period: %s", time.Duration(g.GCGracePeriod)))
 	}
 
-	if g.MemoryMB == 0 {
-		errs = append(errs, fmt.Errorf("missing required plugin config: memory_mb"))
+	if g.MaxParallelism < 0 {
+		errs = append(errs, fmt.Errorf("invalid max_parallelism: %d", g.MaxParallelism))
+	}
+
+	if g.Protocol != protocolAuto {
+		if err := provider.Protocol(g.Protocol).Valid(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid protocol: %s", g.Protocol))
+		}
+	}
+
+	if g.Protocol == string(provider.ProtocolWinRM) && !g.hasPasswordCredentials() {
+		if g.settings.UseStaticCredentials {
+			errs = append(errs, fmt.Errorf("winrm requires a password when using static credentials"))
+		} else {
+			errs = append(errs, fmt.Errorf("winrm requires dynamic_credentials to be password"))
+		}
+	}
+
+	if g.UserData != "" && g.UserDataFile != "" {
+		errs = append(errs, fmt.Errorf("user_data and user_data_file are mutually exclusive"))
+	}
+
+	if g.DynamicCredentials != dynamicCredentialsKey && g.DynamicCredentials != dynamicCredentialsPassword {
+		errs = append(errs, fmt.Errorf("invalid dynamic_credentials: %s", g.DynamicCredentials))
+	}
+
+	if g.GracefulShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid graceful_shutdown_timeout: %s", time.Duration(g.GracefulShutdownTimeout)))
+	}
+
+	if g.PreDeleteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid pre_delete_timeout: %s", time.Duration(g.PreDeleteTimeout)))
+	}
+
+	switch g.DeleteOnShutdown {
+	case deleteOnShutdownAlways, deleteOnShutdownIfCreated, deleteOnShutdownNever:
+	default:
+		errs = append(errs, fmt.Errorf("invalid delete_on_shutdown: %s", g.DeleteOnShutdown))
 	}
 
 	if g.settings.UseStaticCredentials {
-		if g.settings.Password == "" && g.settings.Key == nil {
+		if !g.staticPassword.isSet() && g.settings.Key == nil {
 			// we don't check Username because with vcd/vmware-tools we have to use either root or Administrator
 			return fmt.Errorf("either root/password password or ssh key are required when using static credentials")
 		}
@@ -88,5 +270,23 @@ func (g *InstanceGroup) populate() error {
 
 	g.parsedURL = parsedURL
 
+	g.tlsConfig, err = g.buildTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	g.authenticator, err = g.newAuthenticator()
+	if err != nil {
+		return err
+	}
+
+	if err := g.loadUserData(); err != nil {
+		return err
+	}
+
+	if err := g.loadCustomizationScripts(); err != nil {
+		return err
+	}
+
 	return nil
 }
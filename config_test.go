@@ -0,0 +1,29 @@
+package vcd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationJSON(t *testing.T) {
+	var config struct {
+		TTL Duration `json:"ttl"`
+	}
+
+	require.NoError(t, json.Unmarshal([]byte(`{"ttl": "90s"}`), &config))
+	require.Equal(t, Duration(90*time.Second), config.TTL)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"ttl": 1000000000}`), &config))
+	require.Equal(t, Duration(time.Second), config.TTL)
+
+	require.Error(t, json.Unmarshal([]byte(`{"ttl": "soon"}`), &config))
+	require.Error(t, json.Unmarshal([]byte(`{"ttl": true}`), &config))
+
+	config.TTL = Duration(5 * time.Minute)
+	b, err := json.Marshal(config)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"ttl": "5m0s"}`, string(b))
+}
@@ -0,0 +1,192 @@
+package vcd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	dynamicCredentialsKey      = "key"
+	dynamicCredentialsPassword = "password"
+
+	// metadataSSHKeyKey holds the private half of the SSH key generated for a VM
+	// when dynamic credentials are used with store_keys_in_metadata.
+	metadataSSHKeyKey = "fleeting-plugin-vcd.ssh-private-key"
+)
+
+// generateSSHKeyPair returns a new ed25519 private key in PEM format,
+// along with its public half in authorized_keys format.
+func generateSSHKeyPair() ([]byte, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("generating ed25519 key: %w", err)
+	}
+
+	pemBlock, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, "", fmt.Errorf("marshalling private key: %w", err)
+	}
+
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, "", fmt.Errorf("generating ssh public key: %w", err)
+	}
+
+	return pem.EncodeToMemory(pemBlock), authorizedKey(sshPubKey), nil
+}
+
+// publicKeyFromPrivate returns the public half of a PEM encoded private key,
+// in authorized_keys format.
+func publicKeyFromPrivate(privateKey []byte) (string, error) {
+	priv, err := ssh.ParseRawPrivateKey(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("reading private key: %w", err)
+	}
+
+	key, ok := priv.(PrivPub)
+	if !ok {
+		return "", fmt.Errorf("key doesn't export PublicKey()")
+	}
+
+	sshPubKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return "", fmt.Errorf("generating ssh public key: %w", err)
+	}
+
+	return authorizedKey(sshPubKey), nil
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// storeVMPrivateKey saves the private key generated for a VM, so it can be handed to the runner
+// by ConnectInfo, even after a restart. It is written to key_store_dir, for the plugin user only,
+// or to the VM metadata with store_keys_in_metadata.
+func (g *InstanceGroup) storeVMPrivateKey(ctx context.Context, vm *govcd.VM, privateKey []byte) error {
+	if !g.StoreKeysInMetadata {
+		path, err := g.keyStorePath(vm.VM.HREF)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(g.KeyStoreDir, 0o700); err != nil {
+			return err
+		}
+
+		return os.WriteFile(path, privateKey, 0o600)
+	}
+
+	task, err := vm.AddMetadataEntryWithVisibilityAsync(
+		metadataSSHKeyKey,
+		string(privateKey),
+		types.MetadataStringValue,
+		types.MetadataReadOnlyVisibility,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
+	return g.waitTask(ctx, task)
+}
+
+// getVMPrivateKey reads back the private key stored by storeVMPrivateKey.
+func (g *InstanceGroup) getVMPrivateKey(vm *govcd.VM) ([]byte, error) {
+	if !g.StoreKeysInMetadata {
+		path, err := g.keyStorePath(vm.VM.HREF)
+		if err != nil {
+			return nil, err
+		}
+
+		return os.ReadFile(path)
+	}
+
+	value, err := vm.GetMetadataByKey(metadataSSHKeyKey, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if value.TypedValue == nil || value.TypedValue.Value == "" {
+		return nil, fmt.Errorf("no private key found in metadata of VM %s", vm.VM.Name)
+	}
+
+	return []byte(value.TypedValue.Value), nil
+}
+
+// deleteVMPrivateKey removes the private key of a deleted VM from key_store_dir.
+func (g *InstanceGroup) deleteVMPrivateKey(href string) {
+	if g.KeyStoreDir == "" || g.StoreKeysInMetadata {
+		return
+	}
+
+	path, err := g.keyStorePath(href)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		g.log.Warn("deleting private key of VM", "id", href, "error", err)
+	}
+}
+
+// keyStorePath returns the file of key_store_dir holding the private key of a VM,
+// named after the last part of its HREF, e.g. vm-<uuid>.
+func (g *InstanceGroup) keyStorePath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(u.Path)
+	if !strings.HasPrefix(name, "vm-") {
+		return "", fmt.Errorf("unexpected VM HREF: %s", href)
+	}
+
+	return filepath.Join(g.KeyStoreDir, name+".pem"), nil
+}
+
+// enableAutoAdminPassword asks VCD to generate a random admin password for the VM
+// during guest customization.
+func enableAutoAdminPassword(vm *govcd.VM) {
+	vm.VM.GuestCustomizationSection.Enabled = boolPointer(true)
+	vm.VM.GuestCustomizationSection.AdminPassword = ""
+	vm.VM.GuestCustomizationSection.AdminPasswordEnabled = boolPointer(true)
+	vm.VM.GuestCustomizationSection.AdminPasswordAuto = boolPointer(true)
+	vm.VM.GuestCustomizationSection.ResetPasswordRequired = boolPointer(false)
+}
+
+// getVMAdminPassword reads back the admin password VCD generated for the VM.
+func getVMAdminPassword(vm *govcd.VM) (string, error) {
+	section, err := vm.GetGuestCustomizationSection()
+	if err != nil {
+		return "", err
+	}
+
+	if section.AdminPassword == "" {
+		return "", fmt.Errorf("no admin password set for VM %s", vm.VM.Name)
+	}
+
+	return section.AdminPassword, nil
+}
+
+// hasPasswordCredentials tells whether the VMs are connected to with a password, as WinRM requires.
+func (g *InstanceGroup) hasPasswordCredentials() bool {
+	if g.settings.UseStaticCredentials {
+		return g.staticPassword.isSet()
+	}
+	return g.DynamicCredentials == dynamicCredentialsPassword
+}
@@ -0,0 +1,71 @@
+package vcd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateSSHKeyPair(t *testing.T) {
+	privateKey, publicKey, err := generateSSHKeyPair()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(publicKey, "ssh-ed25519 "))
+
+	derived, err := publicKeyFromPrivate(privateKey)
+	require.NoError(t, err)
+	require.Equal(t, publicKey, derived)
+
+	_, otherPublicKey, err := generateSSHKeyPair()
+	require.NoError(t, err)
+	require.NotEqual(t, publicKey, otherPublicKey)
+}
+
+func TestAutoProtocol(t *testing.T) {
+	windows := &govcd.VM{VM: &types.Vm{VmSpecSection: &types.VmSpecSection{OsType: "windows2019srv_64Guest"}}}
+	linux := &govcd.VM{VM: &types.Vm{VmSpecSection: &types.VmSpecSection{OsType: "ubuntu64Guest"}}}
+
+	g := &InstanceGroup{Protocol: protocolAuto, DynamicCredentials: dynamicCredentialsPassword}
+	require.Equal(t, provider.ProtocolWinRM, g.vmProtocol(windows))
+	require.Equal(t, provider.ProtocolSSH, g.vmProtocol(linux))
+
+	// without a password, Windows guests are connected to over SSH with the key
+	g.DynamicCredentials = dynamicCredentialsKey
+	require.Equal(t, provider.ProtocolSSH, g.vmProtocol(windows))
+
+	g.settings.UseStaticCredentials = true
+	g.staticPassword = newSecret("static_password", "", "", "")
+	require.Equal(t, provider.ProtocolSSH, g.vmProtocol(windows))
+
+	g.staticPassword = newSecret("static_password", "secret", "", "")
+	require.Equal(t, provider.ProtocolWinRM, g.vmProtocol(windows))
+}
+
+func TestKeyStore(t *testing.T) {
+	g := &InstanceGroup{KeyStoreDir: filepath.Join(t.TempDir(), "keys")}
+	vm := &govcd.VM{VM: &types.Vm{HREF: "https://vcd.example.com/api/vApp/vm-1234", Name: "runner"}}
+
+	require.NoError(t, g.storeVMPrivateKey(context.Background(), vm, []byte("private key")))
+
+	info, err := os.Stat(filepath.Join(g.KeyStoreDir, "vm-1234.pem"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	key, err := g.getVMPrivateKey(vm)
+	require.NoError(t, err)
+	require.Equal(t, []byte("private key"), key)
+
+	g.deleteVMPrivateKey(vm.VM.HREF)
+	_, err = g.getVMPrivateKey(vm)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = g.keyStorePath("https://vcd.example.com/api/vApp/../../etc/passwd")
+	require.Error(t, err)
+}
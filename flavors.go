@@ -0,0 +1,252 @@
+package vcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+// defaultFlavorName is the name of the flavor made of the group settings when no flavors are configured
+const defaultFlavorName = "default"
+
+// Flavor is a kind of VM the group can provision. Unset fields are taken from the group settings:
+// the source (template, or source_vapp and source_vm) as a whole, the storage profile from the placement,
+// the sizing (sizing_policy, or cpu_count, memory_mb and cores_per_socket) as a whole when neither
+// sizing_policy, cpu_count nor memory_mb are set.
+type Flavor struct {
+	Name           string `json:"name"`
+	Template       string `json:"template"`
+	SourceVApp     string `json:"source_vapp"`
+	SourceVM       string `json:"source_vm"`
+	StorageProfile string `json:"storage_profile"`
+	SizingPolicy   string `json:"sizing_policy"`
+	CPUCount       int    `json:"cpu_count"`
+	MemoryMB       int64  `json:"memory_mb"`
+	CoresPerSocket int    `json:"cores_per_socket"`
+
+	// Flavors with the lowest priority are tried first, the next priority being the fallback when
+	// they lack capacity. Among flavors of the same priority, the first one tried is picked at random
+	// in proportion to its weight (default: 1).
+	Priority int `json:"priority"`
+	Weight   int `json:"weight"`
+}
+
+// errFlavorUnavailable tells that a flavor could not be resolved in VCD, e.g. its template is missing.
+var errFlavorUnavailable = errors.New("flavor unavailable")
+
+// usesTemplates tells whether some flavors are deployed from a template of the catalog.
+func (g *InstanceGroup) usesTemplates() bool {
+	for _, f := range g.flavors {
+		if f.Template != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// capacityErrorMarkers are found in the messages of the errors VCD reports when it lacks the capacity to deploy a VM.
+var capacityErrorMarkers = []string{
+	"insufficient",
+	"not enough",
+	"no suitable",
+	"no resource",
+	"quota",
+	"exceed",
+	"capacity",
+}
+
+// resolveFlavors builds the flavors of the group, filling in their unset fields from the group settings.
+func (g *InstanceGroup) resolveFlavors() []*Flavor {
+	if len(g.Flavors) == 0 {
+		return []*Flavor{{
+			Name:           defaultFlavorName,
+			Template:       g.Template,
+			SourceVApp:     g.SourceVApp,
+			SourceVM:       g.SourceVM,
+			SizingPolicy:   g.SizingPolicy,
+			CPUCount:       g.CPUCount,
+			MemoryMB:       g.MemoryMB,
+			CoresPerSocket: g.CoresPerSocket,
+			Weight:         1,
+		}}
+	}
+
+	flavors := make([]*Flavor, 0, len(g.Flavors))
+	for _, flavor := range g.Flavors {
+		f := flavor
+
+		if f.Template == "" && f.SourceVM == "" {
+			f.Template = g.Template
+			f.SourceVApp = g.SourceVApp
+			f.SourceVM = g.SourceVM
+		}
+
+		if f.SizingPolicy == "" && f.CPUCount == 0 && f.MemoryMB == 0 {
+			f.SizingPolicy = g.SizingPolicy
+			f.CPUCount = g.CPUCount
+			f.MemoryMB = g.MemoryMB
+			if f.CoresPerSocket == 0 {
+				f.CoresPerSocket = g.CoresPerSocket
+			}
+		}
+
+		if f.Weight == 0 {
+			f.Weight = 1
+		}
+
+		flavors = append(flavors, &f)
+	}
+
+	return flavors
+}
+
+// validateFlavors checks the flavors built by resolveFlavors.
+func (g *InstanceGroup) validateFlavors() []error {
+	errs := []error{}
+	names := map[string]bool{}
+
+	for i, f := range g.flavors {
+		prefix := ""
+		if len(g.Flavors) > 0 {
+			if f.Name == "" {
+				errs = append(errs, fmt.Errorf("missing name of flavor %d", i))
+			} else if names[f.Name] {
+				errs = append(errs, fmt.Errorf("duplicate flavor: %s", f.Name))
+			}
+			names[f.Name] = true
+			prefix = fmt.Sprintf("flavor %s: ", f.Name)
+		}
+
+		switch {
+		case f.Template == "" && f.SourceVM == "":
+			errs = append(errs, fmt.Errorf("%smissing required plugin config: template or source_vm", prefix))
+		case f.Template != "" && f.SourceVM != "":
+			errs = append(errs, fmt.Errorf("%stemplate and source_vm are mutually exclusive", prefix))
+		case f.SourceVM != "" && f.SourceVApp == "":
+			errs = append(errs, fmt.Errorf("%smissing required plugin config: source_vapp (holding source_vm)", prefix))
+		}
+
+		if f.Weight < 0 {
+			errs = append(errs, fmt.Errorf("%sinvalid weight: %d", prefix, f.Weight))
+		}
+
+		errs = append(errs, g.validateSizing(f, prefix)...)
+	}
+
+	return errs
+}
+
+// orderFlavors returns the flavors in the order they are tried: by priority, and within
+// a priority in a random order weighted by their weight, intn being rand.Intn.
+func orderFlavors(flavors []*Flavor, intn func(n int) int) []*Flavor {
+	byPriority := map[int][]*Flavor{}
+	priorities := []int{}
+	for _, f := range flavors {
+		if _, ok := byPriority[f.Priority]; !ok {
+			priorities = append(priorities, f.Priority)
+		}
+		byPriority[f.Priority] = append(byPriority[f.Priority], f)
+	}
+	sort.Ints(priorities)
+
+	ordered := make([]*Flavor, 0, len(flavors))
+	for _, priority := range priorities {
+		remaining := append([]*Flavor{}, byPriority[priority]...)
+
+		for len(remaining) > 0 {
+			total := 0
+			for _, f := range remaining {
+				total += f.Weight
+			}
+
+			picked := 0
+			if total > 0 {
+				n := intn(total)
+				for n >= remaining[picked].Weight {
+					n -= remaining[picked].Weight
+					picked++
+				}
+			}
+
+			ordered = append(ordered, remaining[picked])
+			remaining = append(remaining[:picked], remaining[picked+1:]...)
+		}
+	}
+
+	return ordered
+}
+
+// addVMOfAnyFlavor provisions a VM in a placement, trying the flavors in turn as long as they lack capacity.
+func (g *InstanceGroup) addVMOfAnyFlavor(ctx context.Context, p *Placement, pooled bool) (*govcd.VM, error) {
+	errs := []error{}
+
+	for _, flavor := range orderFlavors(g.flavors, rand.Intn) {
+		vm, err := g.addVM(ctx, p, flavor, pooled)
+		if err == nil {
+			return vm, nil
+		}
+
+		if len(g.flavors) == 1 {
+			return nil, err
+		}
+
+		errs = append(errs, fmt.Errorf("flavor %s: %w", flavor.Name, err))
+		if ctx.Err() != nil || !isCapacityError(err) {
+			break
+		}
+
+		g.log.Warn("flavor lacks capacity, falling back to the next one", "flavor", flavor.Name, "error", err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// isCapacityError tells whether cloning a VM failed because its flavor can not be
+// provisioned right now, rather than because of the VM itself.
+func isCapacityError(err error) bool {
+	if errors.Is(err, errFlavorUnavailable) {
+		return true
+	}
+
+	var provisioningErr *provisioningError
+	if !errors.As(err, &provisioningErr) || provisioningErr.stage != stageClone {
+		return false
+	}
+
+	// only what VCD reported is looked at, as the rest of the error holds the names of the vApp and VM
+	var taskErr *taskError
+	if errors.As(err, &taskErr) {
+		if taskErr.vcdError == nil {
+			return false
+		}
+		return taskErr.vcdError.MajorErrorCode == http.StatusNotFound || hasCapacityMarker(taskErr.vcdError.Message)
+	}
+
+	if isNotFound(err) {
+		return true
+	}
+
+	// synchronous errors only keep the text govcd makes of the VCD error
+	match := apiErrorPattern.FindStringSubmatch(err.Error())
+	return match != nil && hasCapacityMarker(match[1])
+}
+
+// apiErrorPattern matches the message of a VCD error, as formatted by types.Error.
+var apiErrorPattern = regexp.MustCompile(`API Error: \d+: (.*)$`)
+
+func hasCapacityMarker(message string) bool {
+	message = strings.ToLower(message)
+	for _, marker := range capacityErrorMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
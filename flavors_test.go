@@ -0,0 +1,87 @@
+package vcd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestResolveFlavors(t *testing.T) {
+	g := &InstanceGroup{
+		Template:       "ubuntu",
+		StorageProfile: "ssd",
+		CPUCount:       4,
+		MemoryMB:       8192,
+	}
+
+	flavors := g.resolveFlavors()
+	require.Len(t, flavors, 1)
+	require.Equal(t, &Flavor{Name: defaultFlavorName, Template: "ubuntu", CPUCount: 4, MemoryMB: 8192, Weight: 1}, flavors[0])
+
+	g.Flavors = []Flavor{
+		{Name: "ssd"},
+		{Name: "hdd", StorageProfile: "hdd", Priority: 1, Weight: 3},
+		{Name: "small", SizingPolicy: "small"},
+	}
+
+	flavors = g.resolveFlavors()
+	require.Equal(t, &Flavor{Name: "ssd", Template: "ubuntu", CPUCount: 4, MemoryMB: 8192, Weight: 1}, flavors[0])
+	require.Equal(t, &Flavor{Name: "hdd", Template: "ubuntu", StorageProfile: "hdd", CPUCount: 4, MemoryMB: 8192, Priority: 1, Weight: 3}, flavors[1])
+	require.Equal(t, &Flavor{Name: "small", Template: "ubuntu", SizingPolicy: "small", Weight: 1}, flavors[2])
+
+	g.flavors = flavors
+	require.Empty(t, g.validateFlavors())
+
+	g.Flavors = append(g.Flavors, Flavor{Name: "ssd"})
+	g.flavors = g.resolveFlavors()
+	require.EqualError(t, errors.Join(g.validateFlavors()...), "duplicate flavor: ssd")
+
+	g.Flavors = []Flavor{
+		{Name: "golden", SourceVApp: "golden", SourceVM: "ubuntu"},
+		{Name: "both", Template: "ubuntu", SourceVM: "ubuntu"},
+		{Name: "vm", SourceVM: "ubuntu"},
+	}
+	g.flavors = g.resolveFlavors()
+	require.Equal(t, &Flavor{Name: "golden", SourceVApp: "golden", SourceVM: "ubuntu", CPUCount: 4, MemoryMB: 8192, Weight: 1}, g.flavors[0])
+	require.EqualError(t, errors.Join(g.validateFlavors()...), "flavor both: template and source_vm are mutually exclusive\n"+
+		"flavor vm: missing required plugin config: source_vapp (holding source_vm)")
+}
+
+func TestOrderFlavors(t *testing.T) {
+	a := &Flavor{Name: "a", Priority: 0, Weight: 1}
+	b := &Flavor{Name: "b", Priority: 0, Weight: 3}
+	c := &Flavor{Name: "c", Priority: 1, Weight: 1}
+	d := &Flavor{Name: "d", Priority: -1, Weight: 1}
+
+	flavors := []*Flavor{a, b, c, d}
+
+	// the first pick among a and b falls within the weight of a, or of b
+	require.Equal(t, []*Flavor{d, a, b, c}, orderFlavors(flavors, func(n int) int { return 0 }))
+	require.Equal(t, []*Flavor{d, b, a, c}, orderFlavors(flavors, func(n int) int { return n - 1 }))
+}
+
+func TestIsCapacityError(t *testing.T) {
+	require.True(t, isCapacityError(stageError(stageClone, fmt.Errorf("%w: getting template", errFlavorUnavailable))))
+	require.True(t, isCapacityError(stageError(stageClone, errors.New("API Error: 400: Insufficient storage capacity"))))
+	require.True(t, isCapacityError(stageError(stageClone, &taskError{
+		operation: "vdcRecomposeVapp",
+		vcdError:  &types.Error{MajorErrorCode: 400, Message: "The requested operation would exceed the VDC's quota"},
+	})))
+	require.True(t, isCapacityError(stageError(stageClone, &taskError{
+		operation: "vdcRecomposeVapp",
+		vcdError:  &types.Error{MajorErrorCode: 404, Message: "[ 1234 ] The template was removed"},
+	})))
+	require.False(t, isCapacityError(stageError(stageClone, errors.New("task error: guest OS not supported"))))
+
+	// names holding the markers are not taken for what VCD reported
+	require.False(t, isCapacityError(stageError(stageClone, fmt.Errorf("cloning VM in vApp quota-exceeded: %w", &taskError{
+		operation: "vdcRecomposeVapp",
+		vcdError:  &types.Error{MajorErrorCode: 500, Message: "guest OS not supported"},
+	}))))
+	require.False(t, isCapacityError(stageError(stageClone, &taskError{operation: "capacity-runners", status: "aborted"})))
+	require.False(t, isCapacityError(stageError(stageClone, errors.New("creating VM in vApp capacity-runners: API Error: 500: guest OS not supported"))))
+	require.False(t, isCapacityError(stageError(stagePowerOn, errors.New("insufficient resources"))))
+}
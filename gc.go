@@ -0,0 +1,226 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// startGC runs the garbage collection of orphaned and half-provisioned
+// VMs in the background, until stopGC is called.
+func (g *InstanceGroup) startGC() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	g.stopGC = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(time.Duration(g.GCInterval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := g.collectGarbage(ctx); err != nil && ctx.Err() == nil {
+					g.log.Error("collecting garbage", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// collectGarbage deletes the VMs that have been stuck for longer than the grace
+// period, typically left behind by a failed Increase, the VMs whose provisioning
+// failed before they were tagged, and the vApps left without any VM when every
+// VM has its own vApp.
+func (g *InstanceGroup) collectGarbage(ctx context.Context) error {
+	vapps, err := g.getGroupVApps(ctx)
+	if err != nil {
+		if len(vapps) == 0 {
+			return err
+		}
+		// the garbage of the other placements is still collected
+		g.log.Error("getting vApps of some placements", "error", err)
+	}
+
+	now := time.Now()
+
+	for _, vapp := range vapps {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !g.VAppPerInstance || !vAppIsEmpty(vapp) || g.isProvisioning(vapp.VApp.Name) ||
+			!pastGracePeriod(vapp.VApp.DateCreated, now, time.Duration(g.GCGracePeriod)) {
+			continue
+		}
+
+		g.log.Info("deleting orphaned vApp", "vApp", vapp.VApp.Name)
+		if err := g.deleteVApp(ctx, vapp.VApp.HREF); err != nil {
+			g.log.Error("deleting orphaned vApp", "vApp", vapp.VApp.Name, "error", err)
+		}
+	}
+
+	placed, err := g.getGroupVMsByPlacement(ctx)
+	if err != nil {
+		if len(placed) == 0 {
+			return err
+		}
+		g.log.Error("getting VMs of some placements", "error", err)
+	}
+
+	vms := []*types.Vm{}
+	for _, placedVMs := range placed {
+		vms = append(vms, placedVMs...)
+	}
+
+	for _, vm := range vms {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !g.isStuck(vm, now) {
+			continue
+		}
+
+		g.log.Info("deleting stuck VM", "id", vm.HREF, "name", vm.Name, "status", types.VAppStatuses[vm.Status])
+		if err := g.deleteInstance(ctx, vm.HREF); err != nil {
+			g.log.Error("deleting stuck VM", "id", vm.HREF, "name", vm.Name, "error", err)
+		}
+	}
+
+	tagged, err := g.getTaggedVMs(ctx, metadataGroupKey)
+	if err != nil {
+		return err
+	}
+
+	pooled, err := g.getTaggedVMs(ctx, metadataPoolKey)
+	if err != nil {
+		return err
+	}
+
+	for href := range pooled {
+		tagged[href] = true
+	}
+
+	orphans, err := g.getOrphanedClones(ctx, vapps, tagged, now)
+	if err != nil {
+		return err
+	}
+
+	for _, vm := range orphans {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		g.log.Info("deleting untagged VM", "id", vm.HREF, "name", vm.Name)
+		if err := g.deleteInstance(ctx, vm.HREF); err != nil {
+			g.log.Error("deleting untagged VM", "id", vm.HREF, "name", vm.Name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// getOrphanedClones returns the VMs left behind by a failed provisioning in the vApps created
+// by the plugin: named like the VMs of the group but carrying no tag of the plugin at all, not
+// even of another group. tagged holds the VMs of the group and its warm pool, which are skipped
+// without reading their metadata.
+func (g *InstanceGroup) getOrphanedClones(ctx context.Context, vapps []*govcd.VApp, tagged map[string]bool, now time.Time) ([]*types.Vm, error) {
+	orphans := []*types.Vm{}
+
+	for _, vapp := range vapps {
+		if vapp.VApp.Children == nil {
+			continue
+		}
+
+		candidates := []*types.Vm{}
+		for _, vm := range vapp.VApp.Children.VM {
+			if !tagged[vm.HREF] && g.isOrphanedClone(vm, now) {
+				candidates = append(candidates, vm)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		created, err := g.vAppCreatedByPlugin(vapp)
+		if err != nil {
+			return nil, fmt.Errorf("reading metadata of vApp %s: %w", vapp.VApp.Name, err)
+		}
+		if !created {
+			continue
+		}
+
+		for _, vm := range candidates {
+			pluginVM, err := g.hasPluginMetadata(ctx, vm.HREF)
+			if err != nil {
+				return nil, fmt.Errorf("reading metadata of VM %s: %w", vm.Name, err)
+			}
+			if !pluginVM {
+				orphans = append(orphans, vm)
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// isOrphanedClone tells whether an untagged VM was named by the plugin, is no longer being
+// provisioned and was created longer than the grace period ago: its provisioning failed
+// after the clone, and it would otherwise be left behind for good.
+func (g *InstanceGroup) isOrphanedClone(vm *types.Vm, now time.Time) bool {
+	return strings.HasPrefix(vm.Name, g.VMNamePrefix+"-") && !g.isProvisioning(vm.Name) &&
+		pastGracePeriod(vm.DateCreated, now, time.Duration(g.GCGracePeriod))
+}
+
+// isStuck tells whether a VM never made it to running, or stopped being usable,
+// and was created longer than the grace period ago.
+func (g *InstanceGroup) isStuck(vm *types.Vm, now time.Time) bool {
+	return g.vmState(vm, now) == provider.StateTimeout && pastGracePeriod(vm.DateCreated, now, time.Duration(g.GCGracePeriod))
+}
+
+func vAppIsEmpty(vapp *govcd.VApp) bool {
+	return vapp.VApp.Children == nil || len(vapp.VApp.Children.VM) == 0
+}
+
+// pastGracePeriod tells whether something created at dateCreated, as reported by VCD,
+// is older than the grace period. Unparseable dates are never past it, to be on the safe side.
+func pastGracePeriod(dateCreated string, now time.Time, grace time.Duration) bool {
+	created, err := time.Parse(time.RFC3339, dateCreated)
+	if err != nil {
+		return false
+	}
+
+	return now.Sub(created) > grace
+}
+
+// trackProvisioning marks a VM or vApp as being provisioned, so the garbage
+// collection leaves it alone. The returned function unmarks it.
+func (g *InstanceGroup) trackProvisioning(name string) func() {
+	g.provisioning.Store(name, struct{}{})
+	return func() {
+		g.provisioning.Delete(name)
+	}
+}
+
+func (g *InstanceGroup) isProvisioning(name string) bool {
+	_, ok := g.provisioning.Load(name)
+	return ok
+}
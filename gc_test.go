@@ -0,0 +1,114 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestIsStuck(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	g := &InstanceGroup{
+		BootTimeout:   Duration(10 * time.Minute),
+		GCGracePeriod: Duration(30 * time.Minute),
+		log:           hclog.NewNullLogger(),
+	}
+
+	old := "2024-05-01T11:00:00.000Z"
+	recent := "2024-05-01T11:50:00.000+00:00"
+
+	require.True(t, g.isStuck(&types.Vm{Name: "a", Status: 8, DateCreated: old}, now))
+	require.True(t, g.isStuck(&types.Vm{Name: "a", Status: 0, DateCreated: old}, now))
+	require.True(t, g.isStuck(&types.Vm{Name: "a", Status: -1, DateCreated: old}, now))
+	require.False(t, g.isStuck(&types.Vm{Name: "a", Status: 4, DateCreated: old}, now))
+	require.False(t, g.isStuck(&types.Vm{Name: "a", Status: 8, DateCreated: recent}, now))
+	require.False(t, g.isStuck(&types.Vm{Name: "a", Status: 8, DateCreated: "garbage"}, now))
+
+	done := g.trackProvisioning("a")
+	require.False(t, g.isStuck(&types.Vm{Name: "a", Status: 8, DateCreated: old}, now))
+	done()
+	require.True(t, g.isStuck(&types.Vm{Name: "a", Status: 8, DateCreated: old}, now))
+}
+
+func TestIsOrphanedClone(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	g := &InstanceGroup{
+		VMNamePrefix:  "runner",
+		GCGracePeriod: Duration(30 * time.Minute),
+	}
+
+	old := "2024-05-01T11:00:00.000Z"
+	recent := "2024-05-01T11:50:00.000+00:00"
+
+	require.True(t, g.isOrphanedClone(&types.Vm{Name: "runner-abcd1234", DateCreated: old}, now))
+	require.False(t, g.isOrphanedClone(&types.Vm{Name: "runner-abcd1234", DateCreated: recent}, now))
+	require.False(t, g.isOrphanedClone(&types.Vm{Name: "runner-abcd1234", DateCreated: "garbage"}, now))
+	require.False(t, g.isOrphanedClone(&types.Vm{Name: "database", DateCreated: old}, now))
+	require.False(t, g.isOrphanedClone(&types.Vm{Name: "runners-db", DateCreated: old}, now))
+
+	done := g.trackProvisioning("runner-abcd1234")
+	require.False(t, g.isOrphanedClone(&types.Vm{Name: "runner-abcd1234", DateCreated: old}, now))
+	done()
+	require.True(t, g.isOrphanedClone(&types.Vm{Name: "runner-abcd1234", DateCreated: old}, now))
+}
+
+func TestGetOrphanedClones(t *testing.T) {
+	metadata := map[string]string{
+		// the vApp created by the group, shared with another group
+		"/api/vApp/vapp-1": "runners",
+		// a VM of the other group
+		"/api/vApp/vm-2": "others",
+	}
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", types.MimeMetaData)
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/vApp/vapp-1/metadata/"+metadataGroupKey:
+			fmt.Fprintf(w, `<MetadataValue xmlns="http://www.vmware.com/vcloud/v1.5" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"><TypedValue xsi:type="MetadataStringValue"><Value>%s</Value></TypedValue></MetadataValue>`, metadata["/api/vApp/vapp-1"])
+		case r.Method == http.MethodGet && r.URL.Path == "/api/vApp/vm-2/metadata/":
+			fmt.Fprintf(w, `<Metadata xmlns="http://www.vmware.com/vcloud/v1.5" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"><MetadataEntry><Key>%s</Key><TypedValue xsi:type="MetadataStringValue"><Value>%s</Value></TypedValue></MetadataEntry></Metadata>`, metadataGroupKey, metadata["/api/vApp/vm-2"])
+		case r.Method == http.MethodGet && r.URL.Path == "/api/vApp/vm-3/metadata/":
+			fmt.Fprint(w, `<Metadata xmlns="http://www.vmware.com/vcloud/v1.5"></Metadata>`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	old := "2024-05-01T11:00:00.000Z"
+
+	g := &InstanceGroup{
+		Name:          "runners",
+		GCGracePeriod: Duration(30 * time.Minute),
+		log:           hclog.NewNullLogger(),
+		vcdClient:     client,
+	}
+
+	vapp := govcd.NewVApp(&client.Client)
+	vapp.VApp.HREF = serverURL + "/api/vApp/vapp-1"
+	vapp.VApp.Children = &types.VAppChildren{VM: []*types.Vm{
+		{HREF: serverURL + "/api/vApp/vm-1", Name: "-aaaa1111", DateCreated: old},
+		{HREF: serverURL + "/api/vApp/vm-2", Name: "-bbbb2222", DateCreated: old},
+		{HREF: serverURL + "/api/vApp/vm-3", Name: "-cccc3333", DateCreated: old},
+		{HREF: serverURL + "/api/vApp/vm-4", Name: "database", DateCreated: old},
+	}}
+	// vm-1 is an instance of the group
+	tagged := map[string]bool{serverURL + "/api/vApp/vm-1": true}
+
+	orphans, err := g.getOrphanedClones(context.Background(), []*govcd.VApp{vapp}, tagged, now)
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	require.Equal(t, serverURL+"/api/vApp/vm-3", orphans[0].HREF)
+
+	// nothing is collected from a vApp the group did not create
+	metadata["/api/vApp/vapp-1"] = "others"
+	orphans, err = g.getOrphanedClones(context.Background(), []*govcd.VApp{vapp}, tagged, now)
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+}
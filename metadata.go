@@ -0,0 +1,262 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// Metadata set on every VM created by the plugin, besides metadataGroupKey.
+// Only the VMs tagged with the name of the instance group are considered part of it.
+const (
+	metadataInstanceIDKey = "fleeting-plugin-vcd.instance-id"
+	metadataCreatedAtKey  = "fleeting-plugin-vcd.created-at"
+	metadataVersionKey    = "fleeting-plugin-vcd.version"
+	metadataFlavorKey     = "fleeting-plugin-vcd.flavor"
+	metadataPlacementKey  = "fleeting-plugin-vcd.placement"
+
+	// metadataPoolKey replaces metadataGroupKey on the VMs waiting in the warm pool,
+	// which are not instances of the group until they are taken out of it
+	metadataPoolKey = "fleeting-plugin-vcd.pool"
+)
+
+// tagVM sets the metadata identifying the VM as an instance of this group, or as waiting in its warm pool.
+func (g *InstanceGroup) tagVM(ctx context.Context, vm *govcd.VM, p *Placement, flavor *Flavor, pooled bool) error {
+	tags := map[string]string{
+		metadataInstanceIDKey: vm.VM.HREF,
+		metadataCreatedAtKey:  time.Now().UTC().Format(time.RFC3339),
+		metadataVersionKey:    Version.Version,
+		metadataFlavorKey:     flavor.Name,
+		metadataPlacementKey:  p.Name,
+	}
+
+	if pooled {
+		tags[metadataPoolKey] = g.Name
+	} else {
+		tags[metadataGroupKey] = g.Name
+	}
+
+	return g.mergeMetadata(ctx, vm, tags)
+}
+
+// mergeMetadata sets string metadata entries on a VM, leaving the others as they are.
+func (g *InstanceGroup) mergeMetadata(ctx context.Context, vm *govcd.VM, tags map[string]string) error {
+	metadata := map[string]types.MetadataValue{}
+	for key, value := range tags {
+		metadata[key] = types.MetadataValue{
+			TypedValue: &types.MetadataTypedValue{
+				XsiType: types.MetadataStringValue,
+				Value:   value,
+			},
+		}
+	}
+
+	task, err := vm.MergeMetadataWithMetadataValuesAsync(metadata)
+	if err != nil {
+		return err
+	}
+
+	return g.waitTask(ctx, task)
+}
+
+// isGroupVM tells whether the VM is tagged as an instance of this group.
+func (g *InstanceGroup) isGroupVM(vm *govcd.VM) (bool, error) {
+	value, err := vm.GetMetadataByKey(metadataGroupKey, false)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return value.TypedValue != nil && value.TypedValue.Value == g.Name, nil
+}
+
+// hasPluginMetadata tells whether the VM is tagged by the plugin, for any group,
+// either as an instance or as waiting in a warm pool.
+func (g *InstanceGroup) hasPluginMetadata(ctx context.Context, href string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	client, err := g.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	vm := govcd.NewVM(&client.Client)
+	vm.VM.HREF = href
+
+	metadata, err := vm.GetMetadata()
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range metadata.MetadataEntry {
+		if entry.Key == metadataGroupKey || entry.Key == metadataPoolKey {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// getGroupVMs returns the VMs of this instance group, leaving out whatever
+// else lives in its vApps.
+func (g *InstanceGroup) getGroupVMs(ctx context.Context, vapps []*govcd.VApp) ([]*types.Vm, error) {
+	tagged, err := g.getTaggedVMs(ctx, metadataGroupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := []*types.Vm{}
+	for _, vapp := range vapps {
+		if vapp.VApp.Children == nil {
+			continue
+		}
+
+		for _, vm := range vapp.VApp.Children.VM {
+			if !tagged[vm.HREF] {
+				g.log.Debug("ignoring VM not tagged with the instance group", "id", vm.HREF, "name", vm.Name, "vApp", vapp.VApp.Name)
+				continue
+			}
+			vms = append(vms, vm)
+		}
+	}
+
+	return vms, nil
+}
+
+// getTaggedVMs returns the HREFs of the VMs whose metadata key is the name of this group, in any VDC.
+func (g *InstanceGroup) getTaggedVMs(ctx context.Context, key string) (map[string]bool, error) {
+	records, err := g.getTaggedVMRecords(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := map[string]bool{}
+	for _, record := range records {
+		tagged[record.HREF] = true
+	}
+
+	return tagged, nil
+}
+
+// getTaggedVMRecords returns the query records of the VMs whose metadata key is the name
+// of this group, in any VDC. They hold enough to report the state of the VMs.
+func (g *InstanceGroup) getTaggedVMRecords(ctx context.Context, key string) ([]*types.QueryResultVMRecordType, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	resources, err := g.getResources()
+	if err != nil {
+		return nil, err
+	}
+
+	client := resources.client
+
+	queryType := client.Client.GetQueryType(types.QtVm)
+	filter := fmt.Sprintf("isVAppTemplate==false;metadata:%s==STRING:%s",
+		key,
+		url.QueryEscape(g.Name),
+	)
+
+	pages, err := queryAll(ctx, &client.Client, queryType, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*types.QueryResultVMRecordType{}
+	for _, page := range pages {
+		if client.Client.IsSysAdmin {
+			records = append(records, page.AdminVMRecord...)
+		} else {
+			records = append(records, page.VMRecord...)
+		}
+	}
+
+	return records, nil
+}
+
+// vmStatusCodes maps the statuses of the query records to the codes of types.VAppStatuses.
+var vmStatusCodes = func() map[string]int {
+	codes := map[string]int{}
+	for code, status := range types.VAppStatuses {
+		codes[status] = code
+	}
+	return codes
+}()
+
+// unknownVMStatus is the code of a status missing from types.VAppStatuses.
+const unknownVMStatus = -100
+
+// recordVM turns the query record of a VM into the parts of a VM vmState looks at.
+func recordVM(record *types.QueryResultVMRecordType) *types.Vm {
+	status, ok := vmStatusCodes[record.Status]
+	if !ok {
+		status = unknownVMStatus
+	}
+
+	return &types.Vm{
+		HREF:        record.HREF,
+		Name:        record.Name,
+		Status:      status,
+		DateCreated: record.DateCreated,
+	}
+}
+
+// queryPageSize is the number of records fetched per page by queryAll, the most VCD returns by default.
+const queryPageSize = 128
+
+// queryAll runs a query with an encoded filter, fetching all the pages of its results
+// as VCD only returns the first 25 records otherwise.
+func queryAll(ctx context.Context, client *govcd.Client, queryType string, filter string) ([]*types.QueryResultRecordsType, error) {
+	pages := []*types.QueryResultRecordsType{}
+
+	for page := 1; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		results, err := client.QueryWithNotEncodedParams(map[string]string{
+			"page":     strconv.Itoa(page),
+			"pageSize": strconv.Itoa(queryPageSize),
+		}, map[string]string{
+			"type":          queryType,
+			"filter":        filter,
+			"filterEncoded": "true",
+		})
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, results.Results)
+
+		if page*queryPageSize >= int(results.Results.Total) {
+			return pages, nil
+		}
+	}
+}
+
+// deleteGroupInstance deletes a VM, refusing to if it is not an instance of this group.
+func (g *InstanceGroup) deleteGroupInstance(ctx context.Context, href string) error {
+	vm, err := g.getVM(ctx, href)
+	if err != nil {
+		return err
+	}
+
+	ok, err := g.isGroupVM(vm)
+	if err != nil {
+		return fmt.Errorf("reading metadata of VM %s: %w", vm.VM.Name, err)
+	}
+	if !ok {
+		return fmt.Errorf("VM %s is not tagged as an instance of group %s", vm.VM.Name, g.Name)
+	}
+
+	return g.deleteInstance(ctx, href)
+}
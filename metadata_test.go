@@ -0,0 +1,52 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestQueryAll(t *testing.T) {
+	const total = 130
+
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(queryPageSize), r.URL.Query().Get("pageSize"))
+
+		w.Header().Set("Content-Type", types.MimeQueryRecords)
+		fmt.Fprintf(w, `<QueryResultRecords xmlns="http://www.vmware.com/vcloud/v1.5" page="%d" pageSize="%d" total="%d">`, page, queryPageSize, total)
+		for i := (page - 1) * queryPageSize; i < min(page*queryPageSize, total); i++ {
+			fmt.Fprintf(w, `<VMRecord href="http://vcd/api/vApp/vm-%d"/>`, i)
+		}
+		fmt.Fprint(w, `</QueryResultRecords>`)
+	})
+
+	pages, err := queryAll(context.Background(), &client.Client, types.QtVm, "isVAppTemplate==false")
+	require.NoError(t, err)
+	require.Len(t, pages, 2)
+	require.Len(t, pages[0].VMRecord, queryPageSize)
+	require.Len(t, pages[1].VMRecord, total-queryPageSize)
+}
+
+func TestRecordVM(t *testing.T) {
+	vm := recordVM(&types.QueryResultVMRecordType{
+		HREF:        "https://vcd.example.com/api/vApp/vm-1",
+		Name:        "runner-abcd1234",
+		Status:      "POWERED_ON",
+		DateCreated: "2024-05-01T11:00:00.000Z",
+	})
+	require.Equal(t, &types.Vm{
+		HREF:        "https://vcd.example.com/api/vApp/vm-1",
+		Name:        "runner-abcd1234",
+		Status:      4,
+		DateCreated: "2024-05-01T11:00:00.000Z",
+	}, vm)
+
+	require.Equal(t, unknownVMStatus, recordVM(&types.QueryResultVMRecordType{Status: "SOMETHING_NEW"}).Status)
+}
@@ -0,0 +1,376 @@
+package vcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// defaultPlacementName is the name of the placement made of the group settings when no placements are configured
+const defaultPlacementName = "default"
+
+// How Increase picks the placement of a new VM, set with placement_strategy
+const (
+	// placementSpread picks the placement with the fewest instances
+	placementSpread = "spread"
+	// placementFillFirst picks the first placement that is not full
+	placementFillFirst = "fill_first"
+	// placementFailover picks the first placement, unless it recently failed to provision a VM
+	placementFailover = "failover"
+)
+
+// Placement is a VDC the group provisions VMs in. Unset fields are taken from the group settings.
+type Placement struct {
+	Name              string `json:"name"`
+	VirtualDatacenter string `json:"virtual_datacenter"`
+	Network           string `json:"network"`
+	StorageProfile    string `json:"storage_profile"` // used by the flavors without a storage profile
+	VApp              string `json:"vapp"`
+
+	// Maximum number of instances in the placement, by default as many as its vApps can hold
+	MaxInstances int `json:"max_instances"`
+}
+
+// errPlacementUnavailable tells that a placement could not be resolved in VCD, e.g. its VDC is unreachable.
+var errPlacementUnavailable = errors.New("placement unavailable")
+
+// resolvePlacements builds the placements of the group, filling in their unset fields from the group settings.
+func (g *InstanceGroup) resolvePlacements() []*Placement {
+	if len(g.Placements) == 0 {
+		return []*Placement{{
+			Name:              defaultPlacementName,
+			VirtualDatacenter: g.VirtualDatacenter,
+			Network:           g.Network,
+			StorageProfile:    g.StorageProfile,
+			VApp:              g.VApp,
+		}}
+	}
+
+	placements := make([]*Placement, 0, len(g.Placements))
+	for _, placement := range g.Placements {
+		p := placement
+
+		if p.VirtualDatacenter == "" {
+			p.VirtualDatacenter = g.VirtualDatacenter
+		}
+
+		if p.Network == "" {
+			p.Network = g.Network
+		}
+
+		if p.StorageProfile == "" {
+			p.StorageProfile = g.StorageProfile
+		}
+
+		if p.VApp == "" {
+			p.VApp = g.VApp
+		}
+
+		placements = append(placements, &p)
+	}
+
+	return placements
+}
+
+// validatePlacements checks the placements built by resolvePlacements.
+func (g *InstanceGroup) validatePlacements() []error {
+	errs := []error{}
+	names := map[string]bool{}
+	vapps := map[string]bool{}
+
+	for i, p := range g.placements {
+		prefix := ""
+		if len(g.Placements) > 0 {
+			if p.Name == "" {
+				errs = append(errs, fmt.Errorf("missing name of placement %d", i))
+			} else if names[p.Name] {
+				errs = append(errs, fmt.Errorf("duplicate placement: %s", p.Name))
+			}
+			names[p.Name] = true
+			prefix = fmt.Sprintf("placement %s: ", p.Name)
+		}
+
+		if p.VirtualDatacenter == "" {
+			errs = append(errs, fmt.Errorf("%smissing required plugin config: virtual_datacenter", prefix))
+		}
+
+		if p.Network == "" {
+			errs = append(errs, fmt.Errorf("%smissing required plugin config: network", prefix))
+		}
+
+		if g.VAppPerInstance && p.VApp == "" {
+			errs = append(errs, fmt.Errorf("%smissing required plugin config: vapp (used as name prefix with vapp_per_instance)", prefix))
+		}
+
+		vapp := p.VirtualDatacenter + "/" + p.VApp
+		if p.VApp != "" && vapps[vapp] {
+			errs = append(errs, fmt.Errorf("%svapp %s is already used by another placement in VDC %s", prefix, p.VApp, p.VirtualDatacenter))
+		}
+		vapps[vapp] = true
+
+		if p.MaxInstances < 0 {
+			errs = append(errs, fmt.Errorf("%sinvalid max_instances: %d", prefix, p.MaxInstances))
+		}
+	}
+
+	switch g.PlacementStrategy {
+	case placementSpread, placementFillFirst, placementFailover:
+	default:
+		errs = append(errs, fmt.Errorf("invalid placement_strategy: %s", g.PlacementStrategy))
+	}
+
+	if g.FailoverCooldown < 0 {
+		errs = append(errs, fmt.Errorf("invalid failover_cooldown: %s", time.Duration(g.FailoverCooldown)))
+	}
+
+	return errs
+}
+
+// placementCapacity returns how many instances a placement can hold.
+func (g *InstanceGroup) placementCapacity(p *Placement) int {
+	if p.MaxInstances > 0 {
+		return p.MaxInstances
+	}
+
+	if g.VAppPerInstance {
+		return maxVAppsPerGroup
+	}
+	return maxVMsPerVApp
+}
+
+// orderPlacements returns the placements that are not full, in the order the strategy tries them.
+// With the failover strategy, the placements that recently failed are tried last.
+func (g *InstanceGroup) orderPlacements(counts map[string]int, failedRecently func(name string) bool) []*Placement {
+	ordered := []*Placement{}
+	for _, p := range g.placements {
+		if counts[p.Name] < g.placementCapacity(p) {
+			ordered = append(ordered, p)
+		}
+	}
+
+	switch g.PlacementStrategy {
+	case placementSpread:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return counts[ordered[i].Name] < counts[ordered[j].Name]
+		})
+	case placementFailover:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return !failedRecently(ordered[i].Name) && failedRecently(ordered[j].Name)
+		})
+	}
+
+	return ordered
+}
+
+// nextPlacement picks the placement of a new VM among those not tried yet,
+// counting the VM in it right away so that concurrent picks are spread too.
+func (g *InstanceGroup) nextPlacement(tried map[string]bool) *Placement {
+	g.placementsMu.Lock()
+	defer g.placementsMu.Unlock()
+
+	failedRecently := func(name string) bool {
+		return time.Since(g.placementFailures[name]) < time.Duration(g.FailoverCooldown)
+	}
+
+	for _, p := range g.orderPlacements(g.placementCounts, failedRecently) {
+		if !tried[p.Name] {
+			g.placementCounts[p.Name]++
+			return p
+		}
+	}
+
+	return nil
+}
+
+// releasePlacement uncounts a VM that could not be provisioned in a placement,
+// and records the failure for the failover strategy.
+func (g *InstanceGroup) releasePlacement(p *Placement, failed bool) {
+	g.placementsMu.Lock()
+	defer g.placementsMu.Unlock()
+
+	if g.placementCounts[p.Name] > 0 {
+		g.placementCounts[p.Name]--
+	}
+
+	if failed {
+		g.placementFailures[p.Name] = time.Now()
+	}
+}
+
+// setPlacementCounts records the number of instances found in every placement.
+func (g *InstanceGroup) setPlacementCounts(counts map[string]int) {
+	g.placementsMu.Lock()
+	defer g.placementsMu.Unlock()
+
+	for name, count := range counts {
+		g.placementCounts[name] = count
+	}
+}
+
+// addVMAnywhere provisions a VM, for the warm pool if pooled, in the placements picked by the strategy,
+// falling back to the next placement when one is unavailable or lacks capacity.
+func (g *InstanceGroup) addVMAnywhere(ctx context.Context, pooled bool) (*govcd.VM, *Placement, error) {
+	errs := []error{}
+	tried := map[string]bool{}
+
+	for {
+		p := g.nextPlacement(tried)
+		if p == nil {
+			break
+		}
+		tried[p.Name] = true
+
+		vm, err := g.addVMOfAnyFlavor(ctx, p, pooled)
+		if err == nil {
+			return vm, p, nil
+		}
+
+		fallBack := ctx.Err() == nil && placementFailed(err)
+		g.releasePlacement(p, fallBack)
+
+		if len(g.placements) == 1 {
+			return nil, nil, err
+		}
+
+		errs = append(errs, fmt.Errorf("placement %s: %w", p.Name, err))
+		if !fallBack {
+			break
+		}
+
+		g.log.Warn("placement failed, falling back to the next one", "placement", p.Name, "error", err)
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("all placements are full")
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// placementFailed tells whether provisioning a VM failed because of its placement,
+// so another placement may succeed.
+func placementFailed(err error) bool {
+	if errors.Is(err, errPlacementUnavailable) || isCapacityError(err) {
+		return true
+	}
+
+	var provisioningErr *provisioningError
+	return errors.As(err, &provisioningErr) && provisioningErr.stage == stageCreateVApp
+}
+
+// getGroupVMsByPlacement returns the VMs of this instance group by placement, out of a single
+// query of the VMs tagged with the group. The placements that can not be resolved are left out,
+// and their errors returned along the VMs of the others.
+func (g *InstanceGroup) getGroupVMsByPlacement(ctx context.Context) (map[string][]*types.Vm, error) {
+	records, err := g.getTaggedVMRecords(ctx, metadataGroupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	placed := map[string][]*types.Vm{}
+	errs := []error{}
+
+	for _, p := range g.placements {
+		_, resources, err := g.getPlacementResources(p)
+		if err != nil {
+			if len(g.placements) > 1 {
+				err = fmt.Errorf("placement %s: %w", p.Name, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		vdcHREF := resources.VDC().Vdc.HREF
+		placed[p.Name] = []*types.Vm{}
+		for _, record := range records {
+			if g.inPlacement(p, vdcHREF, record) {
+				placed[p.Name] = append(placed[p.Name], recordVM(record))
+			}
+		}
+	}
+
+	return placed, errors.Join(errs...)
+}
+
+// inPlacement tells whether a VM lives in the vApps of a placement, whose VDC is vdcHREF.
+func (g *InstanceGroup) inPlacement(p *Placement, vdcHREF string, record *types.QueryResultVMRecordType) bool {
+	if record.VdcHREF != vdcHREF {
+		return false
+	}
+
+	if g.VAppPerInstance {
+		return strings.HasPrefix(record.ContainerName, p.VApp+"-")
+	}
+
+	return record.ContainerName == p.VApp
+}
+
+// getGroupVApps returns the vApps holding the VMs of this instance group, in every placement.
+// The placements whose vApps can not be listed are left out, and their errors returned along
+// the vApps of the others.
+func (g *InstanceGroup) getGroupVApps(ctx context.Context) ([]*govcd.VApp, error) {
+	vapps := []*govcd.VApp{}
+	errs := []error{}
+
+	for _, p := range g.placements {
+		placed, err := g.getPlacementVApps(ctx, p)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if len(g.placements) > 1 {
+				err = fmt.Errorf("placement %s: %w", p.Name, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		vapps = append(vapps, placed...)
+	}
+
+	return vapps, errors.Join(errs...)
+}
+
+// keepUnlistedInstances completes the states of the instances by placement with the last
+// known states of the placements that could not be listed, so that fleeting does not take
+// their instances as deleted while their VDC is unreachable. It records the result for the next time.
+func (g *InstanceGroup) keepUnlistedInstances(states map[string]map[string]provider.State) {
+	g.placementsMu.Lock()
+	defer g.placementsMu.Unlock()
+
+	for _, p := range g.placements {
+		if _, listed := states[p.Name]; listed {
+			continue
+		}
+
+		last := g.placementStates[p.Name]
+		if len(last) > 0 {
+			g.log.Warn("reporting the last known instances of a placement that could not be listed", "placement", p.Name, "instances", len(last))
+			states[p.Name] = last
+		}
+	}
+
+	g.placementStates = states
+}
+
+// getPlacementResources returns the resolved VCD resources of a placement.
+func (g *InstanceGroup) getPlacementResources(p *Placement) (*vcdResources, *placementResources, error) {
+	resources, err := g.getResources()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	placed := resources.placements[p.Name]
+	if placed.err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errPlacementUnavailable, placed.err)
+	}
+
+	return resources, placed, nil
+}
@@ -0,0 +1,119 @@
+package vcd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestResolvePlacements(t *testing.T) {
+	g := &InstanceGroup{
+		VirtualDatacenter: "vdc1",
+		Network:           "net1",
+		StorageProfile:    "ssd",
+		VApp:              "runners",
+		PlacementStrategy: placementSpread,
+	}
+
+	g.placements = g.resolvePlacements()
+	require.Equal(t, []*Placement{{Name: defaultPlacementName, VirtualDatacenter: "vdc1", Network: "net1", StorageProfile: "ssd", VApp: "runners"}}, g.placements)
+	require.Empty(t, g.validatePlacements())
+
+	g.Placements = []Placement{
+		{Name: "a"},
+		{Name: "b", VirtualDatacenter: "vdc2", Network: "net2", MaxInstances: 10},
+	}
+
+	g.placements = g.resolvePlacements()
+	require.Equal(t, &Placement{Name: "a", VirtualDatacenter: "vdc1", Network: "net1", StorageProfile: "ssd", VApp: "runners"}, g.placements[0])
+	require.Equal(t, &Placement{Name: "b", VirtualDatacenter: "vdc2", Network: "net2", StorageProfile: "ssd", VApp: "runners", MaxInstances: 10}, g.placements[1])
+	require.Empty(t, g.validatePlacements())
+
+	g.Placements = append(g.Placements, Placement{Name: "c", VirtualDatacenter: "vdc2"})
+	g.placements = g.resolvePlacements()
+	require.EqualError(t, errors.Join(g.validatePlacements()...), "placement c: vapp runners is already used by another placement in VDC vdc2")
+}
+
+func TestOrderPlacements(t *testing.T) {
+	g := &InstanceGroup{
+		placements: []*Placement{
+			{Name: "a", MaxInstances: 2},
+			{Name: "b", MaxInstances: 5},
+			{Name: "c", MaxInstances: 5},
+		},
+	}
+
+	names := func(placements []*Placement) []string {
+		result := []string{}
+		for _, p := range placements {
+			result = append(result, p.Name)
+		}
+		return result
+	}
+
+	counts := map[string]int{"a": 1, "b": 3, "c": 0}
+	failed := func(name string) bool { return name == "a" }
+
+	g.PlacementStrategy = placementSpread
+	require.Equal(t, []string{"c", "a", "b"}, names(g.orderPlacements(counts, failed)))
+
+	g.PlacementStrategy = placementFillFirst
+	require.Equal(t, []string{"a", "b", "c"}, names(g.orderPlacements(counts, failed)))
+
+	g.PlacementStrategy = placementFailover
+	require.Equal(t, []string{"b", "c", "a"}, names(g.orderPlacements(counts, failed)))
+
+	// full placements are left out
+	counts["a"] = 2
+	require.Equal(t, []string{"b", "c"}, names(g.orderPlacements(counts, failed)))
+}
+
+func TestKeepUnlistedInstances(t *testing.T) {
+	g := &InstanceGroup{
+		log:        hclog.NewNullLogger(),
+		placements: []*Placement{{Name: "a"}, {Name: "b"}},
+	}
+
+	g.keepUnlistedInstances(map[string]map[string]provider.State{
+		"a": {"vm-1": provider.StateRunning},
+		"b": {"vm-2": provider.StateRunning},
+	})
+
+	// b can not be listed, its instances are still reported as last seen
+	states := map[string]map[string]provider.State{
+		"a": {"vm-1": provider.StateRunning, "vm-3": provider.StateCreating},
+	}
+	g.keepUnlistedInstances(states)
+	require.Equal(t, map[string]map[string]provider.State{
+		"a": {"vm-1": provider.StateRunning, "vm-3": provider.StateCreating},
+		"b": {"vm-2": provider.StateRunning},
+	}, states)
+
+	// once listed again, b reports what it holds
+	states = map[string]map[string]provider.State{"a": {}, "b": {}}
+	g.keepUnlistedInstances(states)
+	require.Empty(t, states["b"])
+}
+
+func TestInPlacement(t *testing.T) {
+	g := &InstanceGroup{}
+	p := &Placement{Name: "a", VApp: "runners"}
+	vdc := "https://vcd.example.com/api/vdc/1"
+
+	record := func(vdcHREF, vapp string) *types.QueryResultVMRecordType {
+		return &types.QueryResultVMRecordType{VdcHREF: vdcHREF, ContainerName: vapp}
+	}
+
+	require.True(t, g.inPlacement(p, vdc, record(vdc, "runners")))
+	require.False(t, g.inPlacement(p, vdc, record(vdc, "runners-abcd1234")))
+	require.False(t, g.inPlacement(p, vdc, record("https://vcd.example.com/api/vdc/2", "runners")))
+
+	g.VAppPerInstance = true
+	require.True(t, g.inPlacement(p, vdc, record(vdc, "runners-abcd1234")))
+	require.False(t, g.inPlacement(p, vdc, record(vdc, "runners")))
+	require.False(t, g.inPlacement(p, vdc, record(vdc, "others-abcd1234")))
+}
@@ -0,0 +1,86 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// Kinds of VM compute policies
+const (
+	sizingPolicy    = "sizing"
+	placementPolicy = "placement"
+)
+
+// getAssignedComputePolicies returns the VM compute policies assigned to the VDC,
+// when any sizing or placement policy is configured.
+func (g *InstanceGroup) getAssignedComputePolicies(client *govcd.VCDClient, vdc *govcd.Vdc) ([]*types.VdcComputePolicyV2, error) {
+	needed := g.PlacementPolicy != ""
+	for _, flavor := range g.flavors {
+		needed = needed || flavor.SizingPolicy != ""
+	}
+
+	if !needed {
+		return nil, nil
+	}
+
+	policies, err := client.GetAllAssignedVdcComputePoliciesV2(vdc.Vdc.ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getting compute policies of VDC %s: %w", vdc.Vdc.Name, err)
+	}
+
+	assigned := make([]*types.VdcComputePolicyV2, 0, len(policies))
+	for _, policy := range policies {
+		assigned = append(assigned, policy.VdcComputePolicyV2)
+	}
+
+	return assigned, nil
+}
+
+// findComputePolicy returns the VM policy with the given name, checking it is of the right kind:
+// placement policies pin VMs to VM groups, sizing policies do not.
+func findComputePolicy(policies []*types.VdcComputePolicyV2, name, kind string) (*types.VdcComputePolicy, error) {
+	names := []string{}
+
+	for _, policy := range policies {
+		if policy.PolicyType != "VdcVmPolicy" || policy.IsVgpuPolicy {
+			continue
+		}
+
+		if isPlacementPolicy(policy) != (kind == placementPolicy) {
+			continue
+		}
+
+		if policy.Name == name {
+			return &policy.VdcComputePolicy, nil
+		}
+		names = append(names, policy.Name)
+	}
+
+	return nil, fmt.Errorf("%s policy %s is not assigned to the VDC (available: %s)", kind, name, strings.Join(names, ", "))
+}
+
+func isPlacementPolicy(policy *types.VdcComputePolicyV2) bool {
+	return len(policy.PvdcNamedVmGroupsMap) > 0 ||
+		len(policy.PvdcLogicalVmGroupsMap) > 0 ||
+		len(policy.NamedVMGroups) > 0 ||
+		len(policy.LogicalVMGroupReferences) > 0
+}
+
+// applyPlacementPolicy sets the placement policy of a freshly cloned VM, keeping its sizing policy.
+func (g *InstanceGroup) applyPlacementPolicy(ctx context.Context, vm *govcd.VM, sizing, placement *types.VdcComputePolicy) error {
+	sizingID := ""
+	if sizing != nil {
+		sizingID = sizing.ID
+	}
+
+	task, err := vm.UpdateComputePolicyV2Async(sizingID, placement.ID, "")
+	if err != nil {
+		return err
+	}
+
+	return g.waitTask(ctx, task)
+}
@@ -0,0 +1,43 @@
+package vcd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestFindComputePolicy(t *testing.T) {
+	policy := func(name string, groups bool) *types.VdcComputePolicyV2 {
+		p := &types.VdcComputePolicyV2{PolicyType: "VdcVmPolicy"}
+		p.Name = name
+		p.ID = "urn:vcloud:vdcComputePolicy:" + name
+		if groups {
+			p.PvdcNamedVmGroupsMap = []types.PvdcNamedVmGroupsMap{{}}
+		}
+		return p
+	}
+
+	kubernetes := policy("k8s", false)
+	kubernetes.PolicyType = "VdcKubernetesPolicy"
+
+	policies := []*types.VdcComputePolicyV2{
+		policy("small", false),
+		policy("licensed-hosts", true),
+		kubernetes,
+	}
+
+	found, err := findComputePolicy(policies, "small", sizingPolicy)
+	require.NoError(t, err)
+	require.Equal(t, "urn:vcloud:vdcComputePolicy:small", found.ID)
+
+	found, err = findComputePolicy(policies, "licensed-hosts", placementPolicy)
+	require.NoError(t, err)
+	require.Equal(t, "urn:vcloud:vdcComputePolicy:licensed-hosts", found.ID)
+
+	_, err = findComputePolicy(policies, "licensed-hosts", sizingPolicy)
+	require.EqualError(t, err, "sizing policy licensed-hosts is not assigned to the VDC (available: small)")
+
+	_, err = findComputePolicy(policies, "k8s", sizingPolicy)
+	require.Error(t, err)
+}
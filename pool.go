@@ -0,0 +1,177 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+// pooledVM is a VM waiting powered off in the warm pool.
+type pooledVM struct {
+	href      string
+	placement string
+}
+
+// startWarmPool keeps warm_pool_size VMs in the warm pool in the background, until stopWarmPool
+// is called. The VMs left over by a previous run are deleted first, as the config may have changed.
+func (g *InstanceGroup) startWarmPool() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	g.refillPool = make(chan struct{}, 1)
+	g.stopWarmPool = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+
+		if err := g.deletePooledVMs(ctx); err != nil && ctx.Err() == nil {
+			g.log.Error("deleting VMs left in the warm pool", "error", err)
+		}
+
+		ticker := time.NewTicker(time.Duration(g.WarmPoolInterval))
+		defer ticker.Stop()
+
+		for {
+			g.fillWarmPool(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-g.refillPool:
+			}
+		}
+	}()
+}
+
+// fillWarmPool provisions VMs until the warm pool is full, giving up until
+// the next attempt as soon as one can not be provisioned.
+func (g *InstanceGroup) fillWarmPool(ctx context.Context) {
+	for ctx.Err() == nil && g.pooledCount() < g.WarmPoolSize {
+		vm, p, err := g.addVMAnywhere(ctx, true)
+		if err != nil {
+			if ctx.Err() == nil {
+				g.log.Error("adding VM to the warm pool", "error", err)
+			}
+			return
+		}
+
+		g.poolMu.Lock()
+		g.pool = append(g.pool, pooledVM{href: vm.VM.HREF, placement: p.Name})
+		g.poolMu.Unlock()
+
+		g.log.Debug("added VM to the warm pool", "id", vm.VM.HREF, "name", vm.VM.Name)
+	}
+}
+
+// pooledCount returns the number of VMs in the warm pool.
+func (g *InstanceGroup) pooledCount() int {
+	g.poolMu.Lock()
+	defer g.poolMu.Unlock()
+
+	return len(g.pool)
+}
+
+// countPooledVMs adds the VMs of the warm pool to the counts of the placements listed.
+func (g *InstanceGroup) countPooledVMs(counts map[string]int) {
+	g.poolMu.Lock()
+	defer g.poolMu.Unlock()
+
+	for _, pooled := range g.pool {
+		if _, ok := counts[pooled.placement]; ok {
+			counts[pooled.placement]++
+		}
+	}
+}
+
+// takePooledVM turns a VM of the warm pool into an instance of the group and powers it on.
+// It returns a nil VM when the pool is empty.
+func (g *InstanceGroup) takePooledVM(ctx context.Context) (*govcd.VM, error) {
+	g.poolMu.Lock()
+	if len(g.pool) == 0 {
+		g.poolMu.Unlock()
+		return nil, nil
+	}
+	pooled := g.pool[0]
+	g.pool = g.pool[1:]
+	g.poolMu.Unlock()
+
+	// replenish the pool without waiting for the next interval
+	select {
+	case g.refillPool <- struct{}{}:
+	default:
+	}
+
+	vm, err := g.getVM(ctx, pooled.href)
+	if err != nil {
+		return nil, fmt.Errorf("getting pooled VM %s: %w", pooled.href, err)
+	}
+	// reported as being created until it is powered on, despite being created a while ago
+	defer g.trackProvisioning(vm.VM.Name)()
+
+	if err := g.claimPooledVM(ctx, vm); err != nil {
+		g.cleanup(ctx, "VM", pooled.href, g.deleteInstance)
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// claimPooledVM swaps the pool tag of a VM for the group tag, and powers it on.
+func (g *InstanceGroup) claimPooledVM(ctx context.Context, vm *govcd.VM) error {
+	err := g.mergeMetadata(ctx, vm, map[string]string{
+		metadataGroupKey:     g.Name,
+		metadataCreatedAtKey: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return stageError(stagePowerOn, fmt.Errorf("tagging VM: %w", err))
+	}
+
+	task, err := vm.DeleteMetadataEntryWithDomainAsync(metadataPoolKey, false)
+	if err != nil {
+		return stageError(stagePowerOn, fmt.Errorf("untagging VM: %w", err))
+	}
+	if err = g.waitTask(ctx, task); err != nil {
+		return stageError(stagePowerOn, fmt.Errorf("untagging VM: %w", err))
+	}
+
+	task, err = vm.PowerOn()
+	if err != nil {
+		return stageError(stagePowerOn, err)
+	}
+	if err = g.waitTask(ctx, task); err != nil {
+		return stageError(stagePowerOn, err)
+	}
+
+	return nil
+}
+
+// deletePooledVMs deletes the VMs tagged as waiting in the warm pool of the group.
+func (g *InstanceGroup) deletePooledVMs(ctx context.Context) error {
+	tagged, err := g.getTaggedVMs(ctx, metadataPoolKey)
+	if err != nil {
+		return err
+	}
+
+	for href := range tagged {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		g.log.Info("deleting VM of the warm pool", "id", href)
+		if err := g.deleteInstance(ctx, href); err != nil {
+			g.log.Error("deleting VM of the warm pool", "id", href, "error", err)
+		}
+	}
+
+	g.poolMu.Lock()
+	g.pool = nil
+	g.poolMu.Unlock()
+
+	return nil
+}
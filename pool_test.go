@@ -0,0 +1,72 @@
+package vcd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestCountPooledVMs(t *testing.T) {
+	g := &InstanceGroup{
+		pool: []pooledVM{
+			{href: "vm-1", placement: "a"},
+			{href: "vm-2", placement: "a"},
+			{href: "vm-3", placement: "b"},
+		},
+	}
+
+	// placement b was not listed, so its count is left alone
+	counts := map[string]int{"a": 1}
+	g.countPooledVMs(counts)
+	require.Equal(t, map[string]int{"a": 3}, counts)
+}
+
+func TestTakePooledVMFromEmptyPool(t *testing.T) {
+	g := &InstanceGroup{}
+
+	vm, err := g.takePooledVM(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, vm)
+}
+
+func TestPowerOnVMNextToPooledVM(t *testing.T) {
+	poweredOn := []string{}
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/power/action/powerOn"):
+			poweredOn = append(poweredOn, strings.TrimSuffix(r.URL.Path, "/power/action/powerOn"))
+			w.WriteHeader(http.StatusAccepted)
+			writeTestTask(w, r, "running")
+		case r.Method == http.MethodGet && r.URL.Path == "/api/task/1":
+			writeTestTask(w, r, "success")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	// the shared vApp holds a VM of the warm pool, vm-1, next to the fresh vm-2
+	vapp := govcd.NewVApp(&client.Client)
+	vapp.VApp.HREF = serverURL + "/api/vApp/vapp-1"
+	vapp.VApp.Children = &types.VAppChildren{VM: []*types.Vm{
+		{HREF: serverURL + "/api/vApp/vm-1", Name: "pooled"},
+		{HREF: serverURL + "/api/vApp/vm-2", Name: "fresh"},
+	}}
+	vm := govcd.NewVM(&client.Client)
+	vm.VM.HREF = serverURL + "/api/vApp/vm-2"
+
+	g := &InstanceGroup{log: hclog.NewNullLogger()}
+	require.NoError(t, g.powerOnVM(context.Background(), vapp, vm))
+	require.Equal(t, []string{"/api/vApp/vm-2"}, poweredOn)
+
+	// with a vApp of its own, the VM is powered on along with its vApp
+	poweredOn = nil
+	g.VAppPerInstance = true
+	require.NoError(t, g.powerOnVM(context.Background(), vapp, vm))
+	require.Equal(t, []string{"/api/vApp/vapp-1"}, poweredOn)
+}
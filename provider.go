@@ -2,18 +2,24 @@ package vcd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/url"
 	"path"
-	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
-	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
 	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
 )
 
 var _ provider.InstanceGroup = (*InstanceGroup)(nil)
 
+const protocolAuto = "auto"
+
 type InstanceGroup struct {
 	Name string `json:"name"`
 
@@ -24,18 +30,165 @@ type InstanceGroup struct {
 	Network           string `json:"network"`
 	IPAllocationMode  string `json:"ip_allocation_mode"`
 	Token             string `json:"token"` // API token (vcd > 10.4 required)
+	TokenFile         string `json:"token_file"`
+	TokenEnv          string `json:"token_env"`
 	Catalog           string `json:"catalog"`
 	Template          string `json:"template"`
-	VApp              string `json:"vapp"` // vApp to deploy workers on
+	VApp              string `json:"vapp"` // vApp to deploy workers on (name prefix when vapp_per_instance is set)
 	VMNamePrefix      string `json:"vm_name_prefix"`
 	StorageProfile    string `json:"storage_profile"`
 	CPUCount          int    `json:"cpu_count"`
 	MemoryMB          int64  `json:"memory_mb"`
 
-	size int
+	// Powered-off VM cloned instead of deploying the template
+	SourceVApp string `json:"source_vapp"`
+	SourceVM   string `json:"source_vm"`
+
+	// Require the VDCs to use fast provisioning, so the VMs are linked clones sharing the disks of their source
+	FastProvisioning bool `json:"fast_provisioning"`
+
+	// VM compute policies assigned to the VDC, the sizing policy replaces cpu_count, memory_mb and the settings below
+	SizingPolicy    string `json:"sizing_policy"`
+	PlacementPolicy string `json:"placement_policy"`
+
+	// Kinds of VMs to provision, made of the settings above when empty
+	Flavors []Flavor `json:"flavors"`
+
+	// VDCs to provision VMs in, made of virtual_datacenter, network, storage_profile and vapp when empty,
+	// and how to pick one: "spread" (default), "fill_first" or "failover"
+	Placements        []Placement `json:"placements"`
+	PlacementStrategy string      `json:"placement_strategy"`
+	FailoverCooldown  Duration    `json:"failover_cooldown"` // how long a placement that failed is tried last
+
+	// CPU topology, cores_per_socket defaults to cpu_count (a single socket)
+	CoresPerSocket int `json:"cores_per_socket"`
+
+	// CPU and memory allocation, the template values are kept when unset.
+	// Limits of -1 mean unlimited, shares levels are LOW, NORMAL, HIGH or CUSTOM (with shares set).
+	CPUReservationMHz   *int64 `json:"cpu_reservation_mhz"`
+	CPULimitMHz         *int64 `json:"cpu_limit_mhz"`
+	CPUSharesLevel      string `json:"cpu_shares_level"`
+	CPUShares           *int   `json:"cpu_shares"`
+	MemoryReservationMB *int64 `json:"memory_reservation_mb"`
+	MemoryLimitMB       *int64 `json:"memory_limit_mb"`
+	MemorySharesLevel   string `json:"memory_shares_level"`
+	MemoryShares        *int   `json:"memory_shares"`
+
+	// Authentication to the VCD API: "token" (default), "password" (local user of the org),
+	// "system" (user of the System org) or "service_account"
+	AuthMethod              string `json:"auth_method"`
+	Username                string `json:"username"`
+	Password                string `json:"password"`
+	PasswordFile            string `json:"password_file"`
+	PasswordEnv             string `json:"password_env"`
+	ServiceAccountTokenFile string `json:"service_account_token_file"` // rewritten on every login, as refresh tokens rotate
+	APIVersion              string `json:"api_version"`
+
+	// How long a VM may take to power on before being reported as timed out
+	BootTimeout Duration `json:"boot_timeout"`
+
+	// Garbage collection of VMs stuck powered off or never finished, and of empty vApps
+	DisableGC     bool     `json:"disable_gc"`
+	GCInterval    Duration `json:"gc_interval"`
+	GCGracePeriod Duration `json:"gc_grace_period"`
+
+	// TLS settings for the VCD API
+	CAFile             string `json:"ca_file"` // PEM bundle of the CAs to trust, on top of the system ones
+	CAPEM              string `json:"ca_pem"`
+	ClientCertFile     string `json:"client_cert_file"`
+	ClientKeyFile      string `json:"client_key_file"`
+	TLSServerName      string `json:"tls_server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	// How long the org, VDC, network, template and storage profile looked up
+	// by name are cached before being resolved again
+	CacheTTL Duration `json:"cache_ttl"`
+
+	// Deploy every VM in its own vApp, so they can be provisioned concurrently
+	VAppPerInstance bool `json:"vapp_per_instance"`
+
+	// Maximum number of VMs provisioned, or deleted, concurrently
+	MaxParallelism int `json:"max_parallelism"`
+
+	// VMs kept provisioned and powered off, so that Increase only has to power them on,
+	// and how often the pool is replenished when provisioning one failed
+	WarmPoolSize     int      `json:"warm_pool_size"`
+	WarmPoolInterval Duration `json:"warm_pool_interval"`
+
+	// Protocol used to connect to the VMs: "ssh", "winrm" or "auto" (winrm for Windows guests).
+	// Defaults to the protocol of the connector config.
+	Protocol string `json:"protocol"`
+
+	// cloud-init user-data template, inline or read from a file
+	UserData     string `json:"user_data"`
+	UserDataFile string `json:"user_data_file"`
+
+	// Templates of shell (Linux) or batch (Windows) snippets run by the guest
+	// customization before and after it customizes the VM
+	PreCustomizationScript  string   `json:"pre_customization_script"`
+	PostCustomizationScript string   `json:"post_customization_script"`
+	Tags                    []string `json:"tags"` // exposed to the templates, e.g. the runner tags
+
+	// Alternatives to the password of the connector config when using static credentials
+	StaticPasswordFile string `json:"static_password_file"`
+	StaticPasswordEnv  string `json:"static_password_env"`
+
+	// Credentials generated for every VM when not using static credentials: "key" or "password"
+	DynamicCredentials string `json:"dynamic_credentials"`
+
+	// Where the generated private keys are kept, readable by the plugin user only, unless
+	// StoreKeysInMetadata keeps them in the VM metadata, readable by the tenant users
+	KeyStoreDir         string `json:"key_store_dir"`
+	StoreKeysInMetadata bool   `json:"store_keys_in_metadata"`
+
+	// How long to wait for the guest OS to shut down before powering off a VM being deleted, disabled if 0
+	GracefulShutdownTimeout Duration `json:"graceful_shutdown_timeout"`
+
+	// Command run over the connector on a running VM before it is deleted
+	PreDeleteCommand string   `json:"pre_delete_command"`
+	PreDeleteTimeout Duration `json:"pre_delete_timeout"`
+
+	// What Shutdown deletes: "always", "if_created" or "never"
+	DeleteOnShutdown string `json:"delete_on_shutdown"`
+
+	size       int
+	flavors    []*Flavor
+	placements []*Placement
 
 	parsedURL *url.URL
-	vAppHREF  string
+	tlsConfig *tls.Config
+
+	token          *secret
+	password       *secret
+	staticPassword *secret
+	authenticator  authenticator
+	vAppHREFs      sync.Map // HREFs of the shared vApps by placement
+	userData       *template.Template
+
+	preCustomizationScript  *template.Template
+	postCustomizationScript *template.Template
+
+	clientMu  sync.Mutex
+	vcdClient *govcd.VCDClient
+
+	resourcesMu sync.Mutex
+	resources   *vcdResources
+
+	sharedVAppMu sync.Map // mutexes serializing adding and removing VMs in the shared vApps, by HREF
+
+	placementsMu      sync.Mutex
+	placementCounts   map[string]int                       // instances by placement, including those being provisioned
+	placementFailures map[string]time.Time                 // last provisioning failure by placement
+	placementStates   map[string]map[string]provider.State // instances last reported by placement
+
+	provisioning sync.Map // names of the VMs and vApps being provisioned
+	deleting     sync.Map // HREFs of the VMs being deleted
+	stopGC       func()
+
+	poolMu       sync.Mutex
+	pool         []pooledVM
+	refillPool   chan struct{} // wakes up the replenishment of the warm pool
+	stopWarmPool func()
 
 	log hclog.Logger
 
@@ -55,37 +208,108 @@ func (g *InstanceGroup) Init(ctx context.Context, logger hclog.Logger, settings
 		return provider.ProviderInfo{}, err
 	}
 
-	if !g.settings.UseStaticCredentials {
-		return provider.ProviderInfo{}, fmt.Errorf("dynamic credentials are not supported yet")
+	if _, err := g.getResources(); err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("resolving VCD resources: %w", err)
 	}
 
-	vapp, err := g.getOrCreateVApp()
-	if err != nil {
-		return provider.ProviderInfo{}, fmt.Errorf("getting or creating vApp: %w", err)
+	g.placementCounts = map[string]int{}
+	g.placementFailures = map[string]time.Time{}
+
+	maxSize := 0
+	for _, p := range g.placements {
+		maxSize += g.placementCapacity(p)
+
+		if g.VAppPerInstance {
+			// vApps are created on demand in Increase, VApp is just their name prefix
+			continue
+		}
+
+		vapp, err := g.getOrCreateVApp(ctx, p)
+		if err != nil {
+			if len(g.placements) == 1 {
+				return provider.ProviderInfo{}, fmt.Errorf("getting or creating vApp: %w", err)
+			}
+			// Increase tries again to get or create the vApp when it picks the placement
+			g.log.Error("getting or creating vApp", "placement", p.Name, "error", err)
+			continue
+		}
+
+		g.vAppHREFs.Store(p.Name, vapp.VApp.HREF) // this speeds-up subsequent calls
 	}
 
-	g.vAppHREF = vapp.VApp.HREF // this speeds-up subsequent calls
+	if !g.DisableGC {
+		g.startGC()
+	}
+
+	if g.WarmPoolSize > 0 {
+		g.startWarmPool()
+	}
+
+	id := path.Join("vcd", g.Org, g.VirtualDatacenter, g.Network, g.VApp)
+	if len(g.Placements) > 0 {
+		id = path.Join("vcd", g.Org, g.Name)
+	}
 
 	return provider.ProviderInfo{
-		ID:        path.Join("vcd", g.Org, g.VirtualDatacenter, g.Network, g.VApp),
-		MaxSize:   128, // max number of VMs in a vApp
+		ID:        id,
+		MaxSize:   maxSize,
 		Version:   Version.Version,
 		BuildInfo: Version.BuildInfo(),
 	}, nil
 }
 
-// TODO(juanfont): Right now, the Increase operation is extremely blocking, as it has to add a VM to the vApp one at a time.
-// This is because vcd does not support performing multiple operations in parallel inside the same vApp.
-// One possible solution is to create a new vApp for each VM, but this would require somehow keeping track of the created vApps.
+// Increase implements provider.InstanceGroup
+//
+// VCD does not support performing multiple operations in parallel inside the same vApp,
+// so with a shared vApp VMs are added one at a time. With vapp_per_instance every VM gets
+// its own vApp, and up to max_parallelism of them are provisioned concurrently.
 func (g *InstanceGroup) Increase(ctx context.Context, delta int) (int, error) {
+	parallelism := 1
+	if g.VAppPerInstance {
+		parallelism = g.MaxParallelism
+	}
+
+	var mu sync.Mutex
 	added := 0
-	for i := 1; i <= delta; i++ {
-		vm, err := g.addVMToVApp()
+	errs := []error{}
+
+	runParallel(delta, parallelism, func(int) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		vm, err := g.takePooledVM(ctx)
+		if vm == nil {
+			if err != nil {
+				g.log.Warn("taking VM from the warm pool failed, provisioning a new one", "error", err)
+			}
+			vm, _, err = g.addVMAnywhere(ctx, false)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
 		if err != nil {
-			continue
+			var provisioningErr *provisioningError
+			if errors.As(err, &provisioningErr) {
+				g.log.Error("adding VM", "stage", provisioningErr.stage, "error", provisioningErr.err)
+			} else {
+				g.log.Error("adding VM", "error", err)
+			}
+			errs = append(errs, err)
+			return
 		}
+
 		added++
-		g.log.Debug("added VM to vApp", "id", vm.VM.HREF, "name", vm.VM.Name)
+		g.log.Debug("added VM", "id", vm.VM.HREF, "name", vm.VM.Name)
+	})
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return added, fmt.Errorf("added %d of %d VMs: %w", added, delta, errors.Join(errs...))
 	}
 
 	return added, nil
@@ -97,14 +321,27 @@ func (g *InstanceGroup) Decrease(ctx context.Context, instances []string) ([]str
 		return nil, nil
 	}
 
+	var mu sync.Mutex
 	deletedVMs := []string{}
 
-	for _, id := range instances {
-		if err := g.deleteVM(id); err != nil {
+	runParallel(len(instances), g.MaxParallelism, func(i int) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		id := instances[i]
+		if err := g.deleteGroupInstance(ctx, id); err != nil {
 			g.log.Error("deleting VM", "id", id, "error", err)
-		} else {
-			deletedVMs = append(deletedVMs, id)
+			return
 		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		deletedVMs = append(deletedVMs, id)
+	})
+
+	if err := ctx.Err(); err != nil {
+		return deletedVMs, err
 	}
 
 	return deletedVMs, nil
@@ -112,40 +349,40 @@ func (g *InstanceGroup) Decrease(ctx context.Context, instances []string) ([]str
 
 // Update implements provider.InstanceGroup
 func (g *InstanceGroup) Update(ctx context.Context, update func(instance string, state provider.State)) error {
-	vapp, err := g.getVApp()
+	placed, err := g.getGroupVMsByPlacement(ctx)
 	if err != nil {
-		return fmt.Errorf("getting vApp: %w", err)
+		if len(placed) == 0 {
+			return fmt.Errorf("getting VMs: %w", err)
+		}
+		// the instances of the other placements are still reported
+		g.log.Error("getting VMs of some placements", "error", err)
 	}
 
-	if vapp.VApp.Children == nil {
-		g.size = 0
-		return nil
+	now := time.Now()
+
+	counts := map[string]int{}
+	states := map[string]map[string]provider.State{}
+	for name, placedVMs := range placed {
+		counts[name] = len(placedVMs)
+		states[name] = map[string]provider.State{}
+		for _, vm := range placedVMs {
+			states[name][vm.HREF] = g.vmState(vm, now)
+		}
 	}
 
-	g.size = len(vapp.VApp.Children.VM)
-
-	for _, vm := range vapp.VApp.Children.VM {
-		var state provider.State
-		switch types.VAppStatuses[vm.Status] {
-		// The lifecycle in VCD is:
-		// - Deploying UNRESOLVED -> POWERED_OFF -> PARTIALLY_POWERED_OFF -> POWERED_ON
-		// - Deleting POWERED_ON -> PARTIALLY_POWERED_OFF -> POWERED_OFF -> DELETING -> UNKNOWN
-		case "UNRESOLVED":
-			state = provider.StateCreating
-		case "POWERED_ON":
-			state = provider.StateRunning
-		case "UNKNOWN":
-			state = provider.StateDeleting
-		case "POWERED_OFF", "PARTIALLY_POWERED_OFF":
-			// as these two states are not final, we just ignore them
-			g.log.Debug("unhandled instance status", "id", vm.HREF, "name", vm.Name, "status", vm.Status)
-		default:
-			g.log.Error("unexpected instance status", "id", vm.HREF, "name", vm.Name, "status", vm.Status)
+	g.keepUnlistedInstances(states)
 
+	size := 0
+	for _, placedStates := range states {
+		for href, state := range placedStates {
+			update(href, state)
+			size++
 		}
-
-		update(vm.HREF, state)
 	}
+	g.size = size
+
+	g.countPooledVMs(counts)
+	g.setPlacementCounts(counts)
 
 	return nil
 }
@@ -156,14 +393,14 @@ func (g *InstanceGroup) ConnectInfo(ctx context.Context, id string) (provider.Co
 		ConnectorConfig: g.settings.ConnectorConfig,
 	}
 
-	vm, err := g.getVM(id)
+	vm, err := g.getVM(ctx, id)
 	if err != nil {
 		return info, err
 	}
 
 	info.Arch = "amd64" // vcd does not support anything else
 
-	if strings.Contains(vm.VM.VmSpecSection.OsType, "windows") {
+	if isWindows(vm) {
 		info.OS = "windows"
 		info.Username = "Administrator" // we rely on VMware Guest Customization
 	} else {
@@ -171,7 +408,29 @@ func (g *InstanceGroup) ConnectInfo(ctx context.Context, id string) (provider.Co
 		info.Username = "root" // we rely on VMware Guest Customization
 	}
 
-	info.Protocol = provider.ProtocolSSH
+	info.Protocol = g.vmProtocol(vm)
+
+	if g.settings.UseStaticCredentials && g.staticPassword.isSet() {
+		info.Password, err = g.staticPassword.get()
+		if err != nil {
+			return info, err
+		}
+	}
+
+	if !g.settings.UseStaticCredentials {
+		switch g.DynamicCredentials {
+		case dynamicCredentialsPassword:
+			info.Password, err = getVMAdminPassword(vm)
+			if err != nil {
+				return info, fmt.Errorf("getting admin password of VM %s: %w", id, err)
+			}
+		default:
+			info.Key, err = g.getVMPrivateKey(vm)
+			if err != nil {
+				return info, fmt.Errorf("getting private key of VM %s: %w", id, err)
+			}
+		}
+	}
 
 	// We assume that the vApp has only one VM with only one NIC
 	if vm.VM.NetworkConnectionSection != nil {
@@ -184,6 +443,10 @@ func (g *InstanceGroup) ConnectInfo(ctx context.Context, id string) (provider.Co
 		}
 	}
 
+	if info.Protocol == provider.ProtocolWinRM && info.Password == "" {
+		return info, fmt.Errorf("winrm requires password credentials for VM %s", id)
+	}
+
 	if info.ExternalAddr == "" {
 		return info, fmt.Errorf("no external address found for VM %s", id)
 	}
@@ -192,6 +455,39 @@ func (g *InstanceGroup) ConnectInfo(ctx context.Context, id string) (provider.Co
 }
 
 func (g *InstanceGroup) Shutdown(ctx context.Context) error {
-	g.log.Info("Shutting down. Deleting vApp", "vApp", g.vAppHREF)
-	return g.deleteVApp(g.vAppHREF)
+	if g.stopGC != nil {
+		g.stopGC()
+	}
+
+	// the VMs of the warm pool are not instances, so they are deleted whatever delete_on_shutdown is
+	if g.stopWarmPool != nil {
+		g.stopWarmPool()
+		if err := g.deletePooledVMs(ctx); err != nil {
+			g.log.Error("deleting VMs of the warm pool", "error", err)
+		}
+	}
+
+	if g.DeleteOnShutdown == deleteOnShutdownNever {
+		g.log.Info("Shutting down. Leaving vApps and VMs in place")
+		return nil
+	}
+
+	vapps, err := g.getGroupVApps(ctx)
+	if err != nil && len(vapps) == 0 {
+		return fmt.Errorf("getting vApps: %w", err)
+	}
+
+	errs := []error{}
+	if err != nil {
+		// the vApps of the other placements are still shut down
+		errs = append(errs, fmt.Errorf("getting vApps: %w", err))
+	}
+
+	for _, vapp := range vapps {
+		if err := g.shutdownVApp(ctx, vapp); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down vApp %s: %w", vapp.VApp.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,51 @@
+package vcd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecrease(t *testing.T) {
+	vcd := newTestVCD(t)
+	for _, vm := range []string{"/api/vApp/vm-1", "/api/vApp/vm-2", "/api/vApp/vm-3"} {
+		vcd.addVM(vm, "/api/vApp/vapp-1", map[string]string{metadataGroupKey: "runners"})
+	}
+	vcd.addVM("/api/vApp/vm-4", "/api/vApp/vapp-1", map[string]string{metadataGroupKey: "others"})
+	vcd.failDelete["/api/vApp/vm-2"] = true
+
+	g := vcd.newTestGroup()
+	g.MaxParallelism = 4
+
+	instances := []string{
+		vcd.serverURL + "/api/vApp/vm-1",
+		vcd.serverURL + "/api/vApp/vm-2",
+		vcd.serverURL + "/api/vApp/vm-3",
+		vcd.serverURL + "/api/vApp/vm-4",
+	}
+
+	// only the instances actually deleted are reported
+	deleted, err := g.Decrease(context.Background(), instances)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{instances[0], instances[2]}, deleted)
+	require.ElementsMatch(t, []string{"/api/vApp/vm-1", "/api/vApp/vm-3"}, vcd.deletedPaths())
+
+	// the VMs of the shared vApp are deleted one at a time
+	require.False(t, vcd.overlapping)
+}
+
+func TestDecreaseCancelled(t *testing.T) {
+	vcd := newTestVCD(t)
+	vcd.addVM("/api/vApp/vm-1", "/api/vApp/vapp-1", map[string]string{metadataGroupKey: "runners"})
+
+	g := vcd.newTestGroup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	deleted, err := g.Decrease(ctx, []string{vcd.serverURL + "/api/vApp/vm-1"})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, deleted)
+	require.Empty(t, vcd.deletedPaths())
+}
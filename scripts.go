@@ -1,19 +1,142 @@
 package vcd
 
-// this could be done much better with cloud-init for Linux,
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// guestTemplateData are the variables available to the guest customization
+// scripts and the cloud-init user-data.
+type guestTemplateData struct {
+	InstanceName string
+	GroupName    string
+	PublicKey    string
+	Tags         []string
+	EnableWinRM  bool
+}
+
+// guestScriptData extends guestTemplateData with the rendered user-supplied
+// pre and post customization scripts, which are embedded in the built-in ones.
+type guestScriptData struct {
+	guestTemplateData
+	PreCustomization  string
+	PostCustomization string
+
+	// KeyAuthorizedByUserData leaves the public key out of the built-in scripts,
+	// the user-supplied ones still getting it
+	KeyAuthorizedByUserData bool
+}
+
+// this could be done much better with cloud-init for Linux (see user_data),
 // and cloud-base for Windows, but this is a quick and dirty way.
 const (
 	linuxGuestCustomizationScript = `#!/bin/bash
 if [ x$1 == x"precustomization" ]; then
 	echo 'Precustom'
+{{- if .PreCustomization}}
+{{.PreCustomization}}
+{{- end}}
 elif [ x$1 == x"postcustomization" ]; then
+	:
+{{- if and .PublicKey (not .KeyAuthorizedByUserData)}}
 	mkdir -p /root/.ssh
 	echo '{{.PublicKey}}' >> /root/.ssh/authorized_keys
 	chmod -R go-rwx /root/.ssh
+{{- end}}
+{{- if .PostCustomization}}
+{{.PostCustomization}}
+{{- end}}
 fi`
 
+	// Labels are used instead of if blocks, so that user-supplied scripts
+	// containing parentheses do not break the batch file.
+	// The fleeting WinRM connector talks plain HTTP with basic auth on port 5985
 	windowsGuestCustomizationScript = `@echo off
-if "%1" == "postcustomization" (
-	echo {{.PublicKey}} > C:\ProgramData\ssh\administrators_authorized_keys
-)`
+if "%1" == "precustomization" goto precustomization
+if "%1" == "postcustomization" goto postcustomization
+goto :eof
+
+:precustomization
+{{- if .PreCustomization}}
+{{.PreCustomization}}
+{{- end}}
+goto :eof
+
+:postcustomization
+{{- if and .PublicKey (not .KeyAuthorizedByUserData)}}
+echo {{.PublicKey}} > C:\ProgramData\ssh\administrators_authorized_keys
+{{- end}}
+{{- if .EnableWinRM}}
+call winrm quickconfig -quiet -force
+call winrm set winrm/config/service @{AllowUnencrypted="true"}
+call winrm set winrm/config/service/auth @{Basic="true"}
+netsh advfirewall firewall add rule name="WinRM-HTTP" dir=in localport=5985 protocol=TCP action=allow
+{{- end}}
+{{- if .PostCustomization}}
+{{.PostCustomization}}
+{{- end}}
+goto :eof`
 )
+
+// loadCustomizationScripts parses the user-supplied pre and post customization script templates.
+func (g *InstanceGroup) loadCustomizationScripts() error {
+	var err error
+
+	if g.PreCustomizationScript != "" {
+		g.preCustomizationScript, err = template.New("pre-customization").Parse(g.PreCustomizationScript)
+		if err != nil {
+			return fmt.Errorf("parsing pre_customization_script: %w", err)
+		}
+	}
+
+	if g.PostCustomizationScript != "" {
+		g.postCustomizationScript, err = template.New("post-customization").Parse(g.PostCustomizationScript)
+		if err != nil {
+			return fmt.Errorf("parsing post_customization_script: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// renderCustomizationScript returns the guest customization script for the VM,
+// or an empty string if there is nothing to customize.
+func (g *InstanceGroup) renderCustomizationScript(windows bool, data guestScriptData) (string, error) {
+	var err error
+
+	data.PreCustomization, err = renderTemplate(g.preCustomizationScript, data.guestTemplateData)
+	if err != nil {
+		return "", fmt.Errorf("rendering pre_customization_script: %w", err)
+	}
+
+	data.PostCustomization, err = renderTemplate(g.postCustomizationScript, data.guestTemplateData)
+	if err != nil {
+		return "", fmt.Errorf("rendering post_customization_script: %w", err)
+	}
+
+	if (data.PublicKey == "" || data.KeyAuthorizedByUserData) && !data.EnableWinRM && data.PreCustomization == "" && data.PostCustomization == "" {
+		return "", nil
+	}
+
+	customizationScript := linuxGuestCustomizationScript
+	if windows {
+		customizationScript = windowsGuestCustomizationScript
+	}
+
+	return renderTemplate(template.Must(template.New("script").Parse(customizationScript)), data)
+}
+
+func renderTemplate(templ *template.Template, data any) (string, error) {
+	if templ == nil {
+		return "", nil
+	}
+
+	var out bytes.Buffer
+	if err := templ.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
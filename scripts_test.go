@@ -0,0 +1,77 @@
+package vcd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCustomizationScript(t *testing.T) {
+	g := &InstanceGroup{
+		PreCustomizationScript:  `echo "pre {{.InstanceName}}"`,
+		PostCustomizationScript: `echo "post {{.GroupName}}{{range .Tags}} {{.}}{{end}}"`,
+	}
+	require.NoError(t, g.loadCustomizationScripts())
+
+	data := guestScriptData{guestTemplateData: guestTemplateData{
+		InstanceName: "runner-abcd1234",
+		GroupName:    "vcd",
+		PublicKey:    "ssh-ed25519 AAAA+key",
+		Tags:         []string{"linux", "docker"},
+	}}
+
+	script, err := g.renderCustomizationScript(false, data)
+	require.NoError(t, err)
+	require.Contains(t, script, `echo 'ssh-ed25519 AAAA+key' >> /root/.ssh/authorized_keys`)
+	require.Contains(t, script, `echo "pre runner-abcd1234"`)
+	require.Contains(t, script, `echo "post vcd linux docker"`)
+
+	script, err = g.renderCustomizationScript(true, data)
+	require.NoError(t, err)
+	require.Contains(t, script, `echo ssh-ed25519 AAAA+key > C:\ProgramData\ssh\administrators_authorized_keys`)
+	require.Contains(t, script, `echo "post vcd linux docker"`)
+	require.NotContains(t, script, "winrm")
+}
+
+func TestRenderCustomizationScriptWinRM(t *testing.T) {
+	g := &InstanceGroup{}
+
+	script, err := g.renderCustomizationScript(true, guestScriptData{guestTemplateData: guestTemplateData{
+		EnableWinRM: true,
+	}})
+	require.NoError(t, err)
+	require.NotContains(t, script, "administrators_authorized_keys")
+	require.Contains(t, script, "winrm quickconfig")
+}
+
+func TestRenderCustomizationScriptEmpty(t *testing.T) {
+	g := &InstanceGroup{}
+
+	script, err := g.renderCustomizationScript(false, guestScriptData{})
+	require.NoError(t, err)
+	require.Empty(t, script)
+}
+
+func TestRenderCustomizationScriptKeyAuthorizedByUserData(t *testing.T) {
+	g := &InstanceGroup{
+		PostCustomizationScript: `echo "{{.PublicKey}}" > /etc/ssh/runner.pub`,
+	}
+	require.NoError(t, g.loadCustomizationScripts())
+
+	script, err := g.renderCustomizationScript(false, guestScriptData{
+		guestTemplateData:       guestTemplateData{PublicKey: "ssh-ed25519 AAAA+key"},
+		KeyAuthorizedByUserData: true,
+	})
+	require.NoError(t, err)
+	require.NotContains(t, script, "authorized_keys")
+	require.Contains(t, script, `echo "ssh-ed25519 AAAA+key" > /etc/ssh/runner.pub`)
+
+	// without user scripts, there is nothing left to customize
+	g = &InstanceGroup{}
+	script, err = g.renderCustomizationScript(false, guestScriptData{
+		guestTemplateData:       guestTemplateData{PublicKey: "ssh-ed25519 AAAA+key"},
+		KeyAuthorizedByUserData: true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, script)
+}
@@ -0,0 +1,94 @@
+package vcd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secret is a config value that can be set inline, or read from a file
+// or an environment variable so it never has to appear in config.toml.
+// Files are read again whenever they change, so secrets can be rotated
+// (e.g. by a Vault agent or a Kubernetes secret mount) without a restart.
+type secret struct {
+	name   string
+	inline string
+	file   string
+	env    string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+}
+
+func newSecret(name, inline, file, env string) *secret {
+	return &secret{name: name, inline: inline, file: file, env: env}
+}
+
+func (s *secret) isSet() bool {
+	return s.inline != "" || s.file != "" || s.env != ""
+}
+
+// validate checks that at most one source is configured, and that the
+// environment variable is set when used.
+func (s *secret) validate() error {
+	sources := 0
+	for _, source := range []string{s.inline, s.file, s.env} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return fmt.Errorf("%s, %s_file and %s_env are mutually exclusive", s.name, s.name, s.name)
+	}
+
+	if s.env != "" && os.Getenv(s.env) == "" {
+		return fmt.Errorf("environment variable %s for %s is not set", s.env, s.name)
+	}
+
+	return nil
+}
+
+// get returns the current value of the secret.
+func (s *secret) get() (string, error) {
+	switch {
+	case s.file != "":
+		return s.readFile()
+	case s.env != "":
+		return os.Getenv(s.env), nil
+	}
+
+	return s.inline, nil
+}
+
+func (s *secret) readFile() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_file: %w", s.name, err)
+	}
+
+	if s.value != "" && info.ModTime().Equal(s.modTime) {
+		return s.value, nil
+	}
+
+	content, err := os.ReadFile(s.file)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_file: %w", s.name, err)
+	}
+
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("%s_file %s is empty", s.name, s.file)
+	}
+
+	s.value = value
+	s.modTime = info.ModTime()
+
+	return value, nil
+}
@@ -0,0 +1,50 @@
+package vcd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(file, []byte("first\n"), 0o600))
+
+	s := newSecret("token", "", file, "")
+	require.NoError(t, s.validate())
+
+	value, err := s.get()
+	require.NoError(t, err)
+	require.Equal(t, "first", value)
+
+	// rotate the secret
+	require.NoError(t, os.WriteFile(file, []byte("second\n"), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+
+	value, err = s.get()
+	require.NoError(t, err)
+	require.Equal(t, "second", value)
+}
+
+func TestSecretFromEnv(t *testing.T) {
+	t.Setenv("FLEETING_PLUGIN_VCD_TEST_TOKEN", "from-env")
+
+	s := newSecret("token", "", "", "FLEETING_PLUGIN_VCD_TEST_TOKEN")
+	require.NoError(t, s.validate())
+
+	value, err := s.get()
+	require.NoError(t, err)
+	require.Equal(t, "from-env", value)
+
+	require.Error(t, newSecret("token", "", "", "FLEETING_PLUGIN_VCD_TEST_UNSET").validate())
+}
+
+func TestSecretValidate(t *testing.T) {
+	require.NoError(t, newSecret("token", "", "", "").validate())
+	require.False(t, newSecret("token", "", "", "").isSet())
+	require.Error(t, newSecret("token", "inline", "/some/file", "").validate())
+}
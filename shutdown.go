@@ -0,0 +1,180 @@
+package vcd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/connector"
+)
+
+// What Shutdown deletes, set with delete_on_shutdown
+const (
+	// deleteOnShutdownAlways deletes the vApps of the group, even a shared vApp the plugin did not create
+	deleteOnShutdownAlways = "always"
+	// deleteOnShutdownIfCreated deletes the vApps created by the plugin, and only the instances
+	// of the group in a shared vApp the plugin did not create
+	deleteOnShutdownIfCreated = "if_created"
+	// deleteOnShutdownNever leaves everything in place
+	deleteOnShutdownNever = "never"
+)
+
+// vAppCreatedByPlugin tells whether the vApp was created by this instance group,
+// as recorded in its metadata by createVApp.
+func (g *InstanceGroup) vAppCreatedByPlugin(vapp *govcd.VApp) (bool, error) {
+	value, err := vapp.GetMetadataByKey(metadataGroupKey, false)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return value.TypedValue != nil && value.TypedValue.Value == g.Name, nil
+}
+
+// shutdownVApp deletes a vApp of the group according to the delete_on_shutdown policy.
+func (g *InstanceGroup) shutdownVApp(ctx context.Context, vapp *govcd.VApp) error {
+	deleteVApp := g.DeleteOnShutdown == deleteOnShutdownAlways
+	if !deleteVApp {
+		created, err := g.vAppCreatedByPlugin(vapp)
+		if err != nil {
+			return fmt.Errorf("reading metadata of vApp %s: %w", vapp.VApp.Name, err)
+		}
+		deleteVApp = created
+	}
+
+	if deleteVApp {
+		g.log.Info("Shutting down. Deleting vApp", "vApp", vapp.VApp.HREF)
+		if err := g.deleteVApp(ctx, vapp.VApp.HREF); err != nil {
+			return err
+		}
+
+		if vapp.VApp.Children != nil {
+			for _, vm := range vapp.VApp.Children.VM {
+				g.deleteVMPrivateKey(vm.HREF)
+			}
+		}
+		return nil
+	}
+
+	vms, err := g.getGroupVMs(ctx, []*govcd.VApp{vapp})
+	if err != nil {
+		return fmt.Errorf("getting VMs: %w", err)
+	}
+
+	errs := []error{}
+	for _, vm := range vms {
+		g.log.Info("Shutting down. Deleting VM of a vApp not created by the plugin", "vApp", vapp.VApp.Name, "id", vm.HREF)
+		if err := g.deleteVM(ctx, vm.HREF); err != nil {
+			errs = append(errs, fmt.Errorf("deleting VM %s: %w", vm.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// preDeleteDialTimeout bounds connecting to a VM to run the pre-delete command,
+// when the connector config does not set a timeout.
+const preDeleteDialTimeout = time.Minute
+
+// stopVM powers off a VM before it is deleted. When the VM is running, the pre-delete
+// command is run first, and the guest OS is shut down if graceful_shutdown_timeout is set,
+// falling back to a hard power-off if it does not shut down in time.
+func (g *InstanceGroup) stopVM(ctx context.Context, href string) error {
+	vm, err := g.getVM(ctx, href)
+	if err != nil {
+		return err
+	}
+
+	if types.VAppStatuses[vm.VM.Status] == "POWERED_ON" {
+		if g.PreDeleteCommand != "" {
+			g.runPreDeleteCommand(ctx, vm)
+		}
+
+		if g.GracefulShutdownTimeout > 0 {
+			err := g.shutdownGuest(ctx, vm)
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			g.log.Warn("guest shutdown failed, powering off", "vm", vm.VM.Name, "error", err)
+		}
+	}
+
+	return g.powerOffVM(ctx, vm)
+}
+
+// powerOffVM undeploys a VM. Failing to do so is fine only when the VM turns out to be powered off already.
+func (g *InstanceGroup) powerOffVM(ctx context.Context, vm *govcd.VM) error {
+	task, err := vm.Undeploy()
+	if err == nil {
+		err = g.waitTask(ctx, task)
+	}
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	if refreshErr := vm.Refresh(); refreshErr != nil {
+		return fmt.Errorf("undeploying VM: %w", errors.Join(err, refreshErr))
+	}
+
+	if status := types.VAppStatuses[vm.VM.Status]; status != "POWERED_OFF" {
+		return fmt.Errorf("undeploying VM (%s): %w", status, err)
+	}
+
+	g.log.Info("VM is already powered off", "vm", vm.VM.Name)
+
+	return nil
+}
+
+// shutdownGuest shuts the guest OS down through VMware Tools, waiting up to graceful_shutdown_timeout.
+func (g *InstanceGroup) shutdownGuest(ctx context.Context, vm *govcd.VM) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(g.GracefulShutdownTimeout))
+	defer cancel()
+
+	task, err := vm.Shutdown()
+	if err != nil {
+		return err
+	}
+
+	return g.waitTask(ctx, task)
+}
+
+// runPreDeleteCommand runs pre_delete_command on the VM over the connector, up to
+// pre_delete_timeout. Failures are only logged, as they must not prevent the deletion.
+func (g *InstanceGroup) runPreDeleteCommand(ctx context.Context, vm *govcd.VM) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(g.PreDeleteTimeout))
+	defer cancel()
+
+	info, err := g.ConnectInfo(ctx, vm.VM.HREF)
+	if err != nil {
+		g.log.Error("running pre-delete command", "vm", vm.VM.Name, "error", err)
+		return
+	}
+
+	if info.Timeout == 0 {
+		info.Timeout = preDeleteDialTimeout
+	}
+
+	var output bytes.Buffer
+	err = connector.Run(ctx, info, connector.ConnectorOptions{
+		RunOptions: connector.RunOptions{
+			Command: g.PreDeleteCommand,
+			Stdout:  &output,
+			Stderr:  &output,
+		},
+	})
+	if err != nil {
+		g.log.Error("running pre-delete command", "vm", vm.VM.Name, "error", err, "output", output.String())
+		return
+	}
+
+	g.log.Debug("ran pre-delete command", "vm", vm.VM.Name, "output", output.String())
+}
@@ -0,0 +1,66 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestPowerOffVM(t *testing.T) {
+	status := 8
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/vApp/vm-1/action/undeploy":
+			w.Header().Set("Content-Type", types.MimeError)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error xmlns="http://www.vmware.com/vcloud/v1.5" majorErrorCode="400" message="The requested operation could not be executed"/>`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/vApp/vm-1":
+			w.Header().Set("Content-Type", types.MimeVM)
+			fmt.Fprintf(w, `<Vm xmlns="http://www.vmware.com/vcloud/v1.5" href="http://%s/api/vApp/vm-1" name="runner" status="%d"/>`, r.Host, status)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	vm := govcd.NewVM(&client.Client)
+	vm.VM.HREF = serverURL + "/api/vApp/vm-1"
+
+	g := &InstanceGroup{log: hclog.NewNullLogger()}
+
+	// undeploying failed as the VM is already off
+	require.NoError(t, g.powerOffVM(context.Background(), vm))
+
+	// undeploying failed while the VM is still on
+	status = 4
+	require.ErrorContains(t, g.powerOffVM(context.Background(), vm), "POWERED_ON")
+}
+
+func TestShutdownVApp(t *testing.T) {
+	vcd := newTestVCD(t)
+	vcd.tagVApp("/api/vApp/vapp-created", map[string]string{metadataGroupKey: "runners"})
+	vcd.addVM("/api/vApp/vm-1", "/api/vApp/vapp-created", map[string]string{metadataGroupKey: "runners"})
+	vcd.addVM("/api/vApp/vm-2", "/api/vApp/vapp-given", map[string]string{metadataGroupKey: "runners"})
+	// added by hand to the vApp handed to the plugin
+	vcd.addVM("/api/vApp/vm-3", "/api/vApp/vapp-given", map[string]string{})
+
+	g := vcd.newTestGroup()
+	g.DeleteOnShutdown = deleteOnShutdownIfCreated
+
+	// the vApp created by the plugin is deleted as a whole
+	require.NoError(t, g.shutdownVApp(context.Background(), vcd.vapp("/api/vApp/vapp-created")))
+	require.Equal(t, []string{"/api/vApp/vapp-created"}, vcd.deletedPaths())
+
+	// only the VMs of the group are deleted from the vApp handed to the plugin
+	require.NoError(t, g.shutdownVApp(context.Background(), vcd.vapp("/api/vApp/vapp-given")))
+	require.Equal(t, []string{"/api/vApp/vapp-created", "/api/vApp/vm-2"}, vcd.deletedPaths())
+
+	g.DeleteOnShutdown = deleteOnShutdownAlways
+	require.NoError(t, g.shutdownVApp(context.Background(), vcd.vapp("/api/vApp/vapp-given")))
+	require.Equal(t, []string{"/api/vApp/vapp-created", "/api/vApp/vm-2", "/api/vApp/vapp-given"}, vcd.deletedPaths())
+}
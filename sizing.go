@@ -0,0 +1,150 @@
+package vcd
+
+import (
+	"fmt"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// Shares levels of the CPU and memory of a VM
+const (
+	sharesLevelLow    = "LOW"
+	sharesLevelNormal = "NORMAL"
+	sharesLevelHigh   = "HIGH"
+	sharesLevelCustom = "CUSTOM"
+)
+
+// unlimited is the limit VCD uses for resources without one
+const unlimited = -1
+
+// hasAllocation tells whether any of the CPU and memory allocation settings is set.
+func (g *InstanceGroup) hasAllocation() bool {
+	return g.CPUReservationMHz != nil || g.CPULimitMHz != nil || g.CPUSharesLevel != "" || g.CPUShares != nil ||
+		g.MemoryReservationMB != nil || g.MemoryLimitMB != nil || g.MemorySharesLevel != "" || g.MemoryShares != nil
+}
+
+// validateAllocations checks the CPU and memory allocation settings, shared by all flavors.
+func (g *InstanceGroup) validateAllocations() []error {
+	errs := []error{}
+	errs = append(errs, validateAllocation("cpu", "mhz", g.CPUReservationMHz, g.CPULimitMHz, g.CPUSharesLevel, g.CPUShares)...)
+	errs = append(errs, validateAllocation("memory", "mb", g.MemoryReservationMB, g.MemoryLimitMB, g.MemorySharesLevel, g.MemoryShares)...)
+	return errs
+}
+
+// validateSizing checks the CPU and memory of a flavor, prefixing the errors with prefix.
+func (g *InstanceGroup) validateSizing(f *Flavor, prefix string) []error {
+	errs := []error{}
+
+	if f.SizingPolicy != "" {
+		if f.CPUCount != 0 || f.MemoryMB != 0 || f.CoresPerSocket != 0 {
+			errs = append(errs, fmt.Errorf("%ssizing_policy can not be combined with cpu_count, memory_mb or cores_per_socket", prefix))
+		}
+		if g.hasAllocation() {
+			errs = append(errs, fmt.Errorf("%ssizing_policy can not be combined with the cpu and memory allocation", prefix))
+		}
+		return errs
+	}
+
+	if f.CPUCount == 0 {
+		errs = append(errs, fmt.Errorf("%smissing required plugin config: cpu_count", prefix))
+	}
+
+	if f.MemoryMB == 0 {
+		errs = append(errs, fmt.Errorf("%smissing required plugin config: memory_mb", prefix))
+	}
+
+	if f.CoresPerSocket < 0 {
+		errs = append(errs, fmt.Errorf("%sinvalid cores_per_socket: %d", prefix, f.CoresPerSocket))
+	} else if f.CoresPerSocket > 0 && f.CPUCount%f.CoresPerSocket != 0 {
+		errs = append(errs, fmt.Errorf("%scpu_count (%d) must be a multiple of cores_per_socket (%d)", prefix, f.CPUCount, f.CoresPerSocket))
+	}
+
+	if g.MemoryReservationMB != nil && f.MemoryMB > 0 && *g.MemoryReservationMB > f.MemoryMB {
+		errs = append(errs, fmt.Errorf("%smemory_reservation_mb (%d) must not exceed memory_mb (%d)", prefix, *g.MemoryReservationMB, f.MemoryMB))
+	}
+
+	return errs
+}
+
+func validateAllocation(resource, unit string, reservation, limit *int64, sharesLevel string, shares *int) []error {
+	errs := []error{}
+
+	if reservation != nil && *reservation < 0 {
+		errs = append(errs, fmt.Errorf("invalid %s_reservation_%s: %d", resource, unit, *reservation))
+	}
+
+	if limit != nil {
+		switch {
+		case *limit == unlimited:
+		case *limit <= 0:
+			errs = append(errs, fmt.Errorf("invalid %s_limit_%s: %d (use %d for unlimited)", resource, unit, *limit, unlimited))
+		case reservation != nil && *limit < *reservation:
+			errs = append(errs, fmt.Errorf("%s_limit_%s (%d) must not be lower than %s_reservation_%s (%d)", resource, unit, *limit, resource, unit, *reservation))
+		}
+	}
+
+	switch sharesLevel {
+	case "", sharesLevelLow, sharesLevelNormal, sharesLevelHigh:
+		if shares != nil {
+			errs = append(errs, fmt.Errorf("%s_shares requires %s_shares_level to be %s", resource, resource, sharesLevelCustom))
+		}
+	case sharesLevelCustom:
+		if shares == nil || *shares <= 0 {
+			errs = append(errs, fmt.Errorf("%s_shares_level %s requires a positive %s_shares", resource, sharesLevelCustom, resource))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid %s_shares_level: %s", resource, sharesLevel))
+	}
+
+	return errs
+}
+
+// applySizing sets the CPU topology and memory of the flavor, and the resource allocation,
+// in the VM spec. Allocation settings left unset keep the values of the template.
+func (g *InstanceGroup) applySizing(spec *types.VmSpecSection, f *Flavor) {
+	cpuCount := f.CPUCount
+	coresPerSocket := f.CoresPerSocket
+	if coresPerSocket == 0 {
+		coresPerSocket = cpuCount // a single socket
+	}
+
+	spec.NumCpus = &cpuCount
+	spec.NumCoresPerSocket = &coresPerSocket
+
+	if spec.MemoryResourceMb == nil {
+		spec.MemoryResourceMb = &types.MemoryResourceMb{}
+	}
+	spec.MemoryResourceMb.Configured = f.MemoryMB
+	setIfNotNil(&spec.MemoryResourceMb.Reservation, g.MemoryReservationMB)
+	setIfNotNil(&spec.MemoryResourceMb.Limit, g.MemoryLimitMB)
+	setShares(&spec.MemoryResourceMb.SharesLevel, &spec.MemoryResourceMb.Shares, g.MemorySharesLevel, g.MemoryShares)
+
+	if g.CPUReservationMHz != nil || g.CPULimitMHz != nil || g.CPUSharesLevel != "" {
+		if spec.CpuResourceMhz == nil {
+			spec.CpuResourceMhz = &types.CpuResourceMhz{}
+		}
+		setIfNotNil(&spec.CpuResourceMhz.Reservation, g.CPUReservationMHz)
+		setIfNotNil(&spec.CpuResourceMhz.Limit, g.CPULimitMHz)
+		setShares(&spec.CpuResourceMhz.SharesLevel, &spec.CpuResourceMhz.Shares, g.CPUSharesLevel, g.CPUShares)
+	}
+}
+
+func setIfNotNil(field **int64, value *int64) {
+	if value != nil {
+		*field = value
+	}
+}
+
+// setShares sets the shares level, and the custom shares which are read-only otherwise.
+func setShares(levelField *string, sharesField **int, level string, shares *int) {
+	if level == "" {
+		return
+	}
+
+	*levelField = level
+	if level == sharesLevelCustom {
+		*sharesField = shares
+	} else {
+		*sharesField = nil
+	}
+}
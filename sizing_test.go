@@ -0,0 +1,100 @@
+package vcd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func int64Pointer(v int64) *int64 {
+	return &v
+}
+
+func intPointer(v int) *int {
+	return &v
+}
+
+func TestValidateSizing(t *testing.T) {
+	valid := func() (*InstanceGroup, *Flavor) {
+		g := &InstanceGroup{
+			CPUReservationMHz:   int64Pointer(1000),
+			CPULimitMHz:         int64Pointer(unlimited),
+			MemoryReservationMB: int64Pointer(4096),
+			MemoryLimitMB:       int64Pointer(8192),
+			MemorySharesLevel:   sharesLevelCustom,
+			MemoryShares:        intPointer(20480),
+		}
+		f := &Flavor{
+			CPUCount:       8,
+			MemoryMB:       4096,
+			CoresPerSocket: 4,
+		}
+		return g, f
+	}
+
+	validate := func(g *InstanceGroup, f *Flavor) []error {
+		return append(g.validateSizing(f, ""), g.validateAllocations()...)
+	}
+
+	require.Empty(t, validate(valid()))
+
+	tests := map[string]func(g *InstanceGroup, f *Flavor){
+		"missing cpu count":          func(g *InstanceGroup, f *Flavor) { f.CPUCount = 0; f.CoresPerSocket = 0 },
+		"cores not dividing cpus":    func(g *InstanceGroup, f *Flavor) { f.CoresPerSocket = 3 },
+		"negative cores":             func(g *InstanceGroup, f *Flavor) { f.CoresPerSocket = -1 },
+		"negative reservation":       func(g *InstanceGroup, f *Flavor) { g.CPUReservationMHz = int64Pointer(-5) },
+		"limit below reservation":    func(g *InstanceGroup, f *Flavor) { g.CPULimitMHz = int64Pointer(500) },
+		"zero limit":                 func(g *InstanceGroup, f *Flavor) { g.MemoryLimitMB = int64Pointer(0) },
+		"reservation above memory":   func(g *InstanceGroup, f *Flavor) { g.MemoryReservationMB = int64Pointer(5000); g.MemoryLimitMB = nil },
+		"custom shares without":      func(g *InstanceGroup, f *Flavor) { g.MemoryShares = nil },
+		"shares without custom":      func(g *InstanceGroup, f *Flavor) { g.MemorySharesLevel = sharesLevelHigh },
+		"invalid shares level":       func(g *InstanceGroup, f *Flavor) { g.CPUSharesLevel = "VERY_HIGH" },
+		"custom shares not positive": func(g *InstanceGroup, f *Flavor) { g.MemoryShares = intPointer(0) },
+		"sizing policy and cpus": func(g *InstanceGroup, f *Flavor) {
+			*g = InstanceGroup{}
+			f.SizingPolicy = "small"
+		},
+		"sizing policy and allocation": func(g *InstanceGroup, f *Flavor) {
+			*f = Flavor{SizingPolicy: "small"}
+		},
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			g, f := valid()
+			modify(g, f)
+			require.Len(t, validate(g, f), 1)
+		})
+	}
+}
+
+func TestApplySizing(t *testing.T) {
+	spec := &types.VmSpecSection{
+		MemoryResourceMb: &types.MemoryResourceMb{
+			Configured:  1024,
+			SharesLevel: sharesLevelCustom,
+			Shares:      intPointer(100),
+		},
+	}
+
+	g := InstanceGroup{
+		CPULimitMHz:       int64Pointer(3000),
+		MemorySharesLevel: sharesLevelHigh,
+	}
+	f := &Flavor{CPUCount: 4, MemoryMB: 2048}
+	g.applySizing(spec, f)
+
+	require.Equal(t, 4, *spec.NumCpus)
+	require.Equal(t, 4, *spec.NumCoresPerSocket)
+	require.Equal(t, int64(2048), spec.MemoryResourceMb.Configured)
+	require.Nil(t, spec.MemoryResourceMb.Reservation)
+	require.Equal(t, sharesLevelHigh, spec.MemoryResourceMb.SharesLevel)
+	require.Nil(t, spec.MemoryResourceMb.Shares)
+	require.Equal(t, int64(3000), *spec.CpuResourceMhz.Limit)
+	require.Empty(t, spec.CpuResourceMhz.SharesLevel)
+
+	f.CoresPerSocket = 2
+	g.applySizing(spec, f)
+	require.Equal(t, 2, *spec.NumCoresPerSocket)
+}
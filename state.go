@@ -0,0 +1,68 @@
+package vcd
+
+import (
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// vmState maps the status of a VM to the state of its instance.
+//
+// The lifecycle in VCD is:
+// - Deploying UNRESOLVED -> POWERED_OFF -> PARTIALLY_POWERED_OFF -> POWERED_ON
+// - Deleting POWERED_ON -> PARTIALLY_POWERED_OFF -> POWERED_OFF -> DELETING -> UNKNOWN
+//
+// As a VM that is not powered on can either still be booting or have been powered off
+// by someone else, the VMs this plugin is not provisioning nor deleting are considered
+// booting until boot_timeout after their creation, and timed out afterwards.
+func (g *InstanceGroup) vmState(vm *types.Vm, now time.Time) provider.State {
+	if g.isDeleting(vm.HREF) {
+		return provider.StateDeleting
+	}
+
+	if g.isProvisioning(vm.Name) {
+		return provider.StateCreating
+	}
+
+	status, ok := types.VAppStatuses[vm.Status]
+	if !ok {
+		g.log.Error("unexpected instance status", "id", vm.HREF, "name", vm.Name, "status", vm.Status)
+		return provider.StateTimeout
+	}
+
+	switch status {
+	case "POWERED_ON":
+		return provider.StateRunning
+
+	case "UNKNOWN":
+		return provider.StateDeleting
+
+	case "UNRESOLVED", "RESOLVED", "DEPLOYED", "POWERED_OFF", "PARTIALLY_POWERED_OFF", "WAITING_FOR_INPUT",
+		"DESCRIPTOR_PENDING", "COPYING_CONTENTS", "DISK_CONTENTS_PENDING", "VAPP_UNDEPLOYED", "VAPP_PARTIALLY_DEPLOYED":
+		if pastGracePeriod(vm.DateCreated, now, time.Duration(g.BootTimeout)) {
+			g.log.Debug("instance did not boot in time", "id", vm.HREF, "name", vm.Name, "status", status)
+			return provider.StateTimeout
+		}
+		return provider.StateCreating
+
+	default:
+		// FAILED_CREATION, SUSPENDED, PARTIALLY_SUSPENDED, UNRECOGNIZED, INCONSISTENT_STATE, MIXED,
+		// QUARANTINED, QUARANTINE_EXPIRED, REJECTED and TRANSFER_TIMEOUT never become usable by themselves.
+		g.log.Debug("instance is not usable", "id", vm.HREF, "name", vm.Name, "status", status)
+		return provider.StateTimeout
+	}
+}
+
+// trackDeleting marks a VM as being deleted. The returned function unmarks it.
+func (g *InstanceGroup) trackDeleting(href string) func() {
+	g.deleting.Store(href, struct{}{})
+	return func() {
+		g.deleting.Delete(href)
+	}
+}
+
+func (g *InstanceGroup) isDeleting(href string) bool {
+	_, ok := g.deleting.Load(href)
+	return ok
+}
@@ -0,0 +1,70 @@
+package vcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestVMState(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	g := &InstanceGroup{
+		BootTimeout: Duration(10 * time.Minute),
+		log:         hclog.NewNullLogger(),
+	}
+
+	booting := "2024-05-01T11:55:00.000Z"
+	old := "2024-05-01T11:00:00.000Z"
+
+	expected := map[string][2]provider.State{
+		// status: {booting, old}
+		"FAILED_CREATION":         {provider.StateTimeout, provider.StateTimeout},
+		"UNRESOLVED":              {provider.StateCreating, provider.StateTimeout},
+		"RESOLVED":                {provider.StateCreating, provider.StateTimeout},
+		"DEPLOYED":                {provider.StateCreating, provider.StateTimeout},
+		"SUSPENDED":               {provider.StateTimeout, provider.StateTimeout},
+		"POWERED_ON":              {provider.StateRunning, provider.StateRunning},
+		"WAITING_FOR_INPUT":       {provider.StateCreating, provider.StateTimeout},
+		"UNKNOWN":                 {provider.StateDeleting, provider.StateDeleting},
+		"UNRECOGNIZED":            {provider.StateTimeout, provider.StateTimeout},
+		"POWERED_OFF":             {provider.StateCreating, provider.StateTimeout},
+		"INCONSISTENT_STATE":      {provider.StateTimeout, provider.StateTimeout},
+		"MIXED":                   {provider.StateTimeout, provider.StateTimeout},
+		"DESCRIPTOR_PENDING":      {provider.StateCreating, provider.StateTimeout},
+		"COPYING_CONTENTS":        {provider.StateCreating, provider.StateTimeout},
+		"DISK_CONTENTS_PENDING":   {provider.StateCreating, provider.StateTimeout},
+		"QUARANTINED":             {provider.StateTimeout, provider.StateTimeout},
+		"QUARANTINE_EXPIRED":      {provider.StateTimeout, provider.StateTimeout},
+		"REJECTED":                {provider.StateTimeout, provider.StateTimeout},
+		"TRANSFER_TIMEOUT":        {provider.StateTimeout, provider.StateTimeout},
+		"VAPP_UNDEPLOYED":         {provider.StateCreating, provider.StateTimeout},
+		"VAPP_PARTIALLY_DEPLOYED": {provider.StateCreating, provider.StateTimeout},
+		"PARTIALLY_POWERED_OFF":   {provider.StateCreating, provider.StateTimeout},
+		"PARTIALLY_SUSPENDED":     {provider.StateTimeout, provider.StateTimeout},
+	}
+
+	require.Len(t, expected, len(types.VAppStatuses))
+
+	for status, name := range types.VAppStatuses {
+		states, ok := expected[name]
+		require.True(t, ok, name)
+
+		require.Equal(t, states[0], g.vmState(&types.Vm{HREF: "vm", Name: "vm", Status: status, DateCreated: booting}, now), name)
+		require.Equal(t, states[1], g.vmState(&types.Vm{HREF: "vm", Name: "vm", Status: status, DateCreated: old}, now), name)
+	}
+
+	require.Equal(t, provider.StateTimeout, g.vmState(&types.Vm{Status: 42, DateCreated: booting}, now))
+
+	powerOff := 8
+	done := g.trackProvisioning("vm")
+	require.Equal(t, provider.StateCreating, g.vmState(&types.Vm{HREF: "vm", Name: "vm", Status: powerOff, DateCreated: old}, now))
+	done()
+
+	done = g.trackDeleting("vm")
+	require.Equal(t, provider.StateDeleting, g.vmState(&types.Vm{HREF: "vm", Name: "vm", Status: powerOff, DateCreated: booting}, now))
+	done()
+}
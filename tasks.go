@@ -0,0 +1,61 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// taskPollInterval is how often waitTask checks the status of a VCD task,
+// the same interval govcd's WaitTaskCompletion uses.
+const taskPollInterval = 3 * time.Second
+
+// taskError is returned by waitTask for a task that did not complete successfully,
+// keeping the error VCD reported, if any, to tell failures apart by their code.
+type taskError struct {
+	operation string
+	status    string
+	vcdError  *types.Error
+}
+
+func (e *taskError) Error() string {
+	message := e.status
+	if e.vcdError != nil {
+		message = e.vcdError.Message
+	}
+	return fmt.Sprintf("task %s did not complete successfully: %s", e.operation, message)
+}
+
+// waitTask waits for a VCD task to finish, like task.WaitTaskCompletion, but
+// gives up as soon as ctx is done. In that case, the task is cancelled in VCD
+// on a best-effort basis, as not every operation can be cancelled.
+func (g *InstanceGroup) waitTask(ctx context.Context, task govcd.Task) error {
+	if task.Task == nil {
+		return nil
+	}
+
+	for {
+		if err := task.Refresh(); err != nil {
+			return fmt.Errorf("refreshing task: %w", err)
+		}
+
+		switch task.Task.Status {
+		case "success":
+			return nil
+		case "error", "aborted", "canceled":
+			return &taskError{operation: task.Task.Operation, status: task.Task.Status, vcdError: task.Task.Error}
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := task.CancelTask(); err != nil {
+				g.log.Debug("unable to cancel task", "task", task.Task.HREF, "error", err)
+			}
+			return ctx.Err()
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// newTestClient returns a client of a fake VCD API served by handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*govcd.VCDClient, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	apiURL, err := url.Parse(server.URL + "/api")
+	require.NoError(t, err)
+
+	return &govcd.VCDClient{Client: govcd.Client{VCDHREF: *apiURL, APIVersion: "37.3", Http: http.Client{}}}, server.URL
+}
+
+// writeTestTask answers with the task /api/task/1 in the given status.
+func writeTestTask(w http.ResponseWriter, r *http.Request, status string) {
+	w.Header().Set("Content-Type", types.MimeTask)
+	fmt.Fprintf(w, `<Task xmlns="http://www.vmware.com/vcloud/v1.5" href="%s/api/task/1" status="%s" operation="testing"></Task>`, "http://"+r.Host, status)
+}
+
+// testVCD is a fake VCD API holding powered-off VMs in vApps, tagged through their metadata.
+// Deleting a VM or vApp runs a task, which fails for the paths in failDelete.
+type testVCD struct {
+	client    *govcd.VCDClient
+	serverURL string
+
+	mu         sync.Mutex
+	parents    map[string]string            // vApp of every VM, by path
+	metadata   map[string]map[string]string // metadata of the VMs and vApps, by path
+	failDelete map[string]bool
+	deleted    []string
+
+	deleting    map[string]int // deletions in progress by vApp, to check that shared vApps are locked
+	overlapping bool
+}
+
+// queryMetadataFilter matches the metadata filter of the queries of tagged VMs.
+// It runs on the raw query, as url.ParseQuery drops the filter with its ";".
+var queryMetadataFilter = regexp.MustCompile(`metadata:([^=]+)==STRING:([^&]+)`)
+
+func newTestVCD(t *testing.T) *testVCD {
+	vcd := &testVCD{
+		parents:    map[string]string{},
+		metadata:   map[string]map[string]string{},
+		failDelete: map[string]bool{},
+		deleting:   map[string]int{},
+	}
+	vcd.client, vcd.serverURL = newTestClient(t, vcd.serveHTTP)
+	return vcd
+}
+
+// addVM adds a VM to a vApp, both named by their path, e.g. /api/vApp/vm-1.
+func (vcd *testVCD) addVM(vm, vapp string, metadata map[string]string) {
+	vcd.mu.Lock()
+	defer vcd.mu.Unlock()
+
+	vcd.parents[vm] = vapp
+	vcd.metadata[vm] = metadata
+}
+
+// tagVApp sets the metadata of a vApp, named by its path.
+func (vcd *testVCD) tagVApp(vapp string, metadata map[string]string) {
+	vcd.mu.Lock()
+	defer vcd.mu.Unlock()
+
+	vcd.metadata[vapp] = metadata
+}
+
+// vapp returns a vApp of the fake API, holding its VMs.
+func (vcd *testVCD) vapp(path string) *govcd.VApp {
+	vcd.mu.Lock()
+	defer vcd.mu.Unlock()
+
+	vapp := govcd.NewVApp(&vcd.client.Client)
+	vapp.VApp.HREF = vcd.serverURL + path
+	vapp.VApp.Name = strings.TrimPrefix(path, "/api/vApp/")
+	vapp.VApp.Children = &types.VAppChildren{}
+	for vm, parent := range vcd.parents {
+		if parent == path {
+			vapp.VApp.Children.VM = append(vapp.VApp.Children.VM, &types.Vm{HREF: vcd.serverURL + vm, Name: strings.TrimPrefix(vm, "/api/vApp/")})
+		}
+	}
+	return vapp
+}
+
+func (vcd *testVCD) deletedPaths() []string {
+	vcd.mu.Lock()
+	defer vcd.mu.Unlock()
+
+	return append([]string{}, vcd.deleted...)
+}
+
+func (vcd *testVCD) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	vcd.mu.Lock()
+	defer vcd.mu.Unlock()
+
+	path := r.URL.Path
+	server := "http://" + r.Host
+
+	switch {
+	case r.Method == http.MethodGet && path == "/api/query":
+		match := queryMetadataFilter.FindStringSubmatch(r.URL.RawQuery)
+		records := ""
+		for vm := range vcd.parents {
+			if match != nil && vcd.metadata[vm][match[1]] == match[2] {
+				records += fmt.Sprintf(`<VMRecord href="%s%s" name="%s"/>`, server, vm, strings.TrimPrefix(vm, "/api/vApp/"))
+			}
+		}
+		w.Header().Set("Content-Type", types.MimeQueryRecords)
+		fmt.Fprintf(w, `<QueryResultRecords xmlns="http://www.vmware.com/vcloud/v1.5" page="1" pageSize="%d" total="%d">%s</QueryResultRecords>`,
+			queryPageSize, strings.Count(records, "<VMRecord"), records)
+
+	case r.Method == http.MethodGet && strings.Contains(path, "/metadata/"):
+		object, key, _ := strings.Cut(path, "/metadata/")
+		value, ok := vcd.metadata[object][key]
+		if !ok {
+			w.Header().Set("Content-Type", types.MimeError)
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error xmlns="http://www.vmware.com/vcloud/v1.5" majorErrorCode="404" minorErrorCode="RESOURCE_NOT_FOUND" message="[ 1 ] The metadata entry does not exist"/>`)
+			return
+		}
+		w.Header().Set("Content-Type", types.MimeMetaData)
+		fmt.Fprintf(w, `<MetadataValue xmlns="http://www.vmware.com/vcloud/v1.5" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"><TypedValue xsi:type="MetadataStringValue"><Value>%s</Value></TypedValue></MetadataValue>`, value)
+
+	case r.Method == http.MethodGet && vcd.parents[path] != "":
+		w.Header().Set("Content-Type", types.MimeVM)
+		fmt.Fprintf(w, `<Vm xmlns="http://www.vmware.com/vcloud/v1.5" href="%[1]s%[2]s" name="%[3]s" status="8"><Link rel="up" type="%[4]s" href="%[1]s%[5]s"/></Vm>`,
+			server, path, strings.TrimPrefix(path, "/api/vApp/"), types.MimeVApp, vcd.parents[path])
+
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/action/undeploy"):
+		w.WriteHeader(http.StatusAccepted)
+		writeTestTaskAt(w, r, "ok", "running")
+
+	case r.Method == http.MethodDelete:
+		vapp := vcd.parents[path]
+		if vapp == "" {
+			vapp = path
+		}
+		if vcd.deleting[vapp] > 0 {
+			vcd.overlapping = true
+		}
+		vcd.deleting[vapp]++
+
+		// the deletion runs for a while, leaving the time for another one to start
+		vcd.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		vcd.mu.Lock()
+
+		vcd.deleting[vapp]--
+
+		w.WriteHeader(http.StatusAccepted)
+		if vcd.failDelete[path] {
+			writeTestTaskAt(w, r, "failed", "running")
+			return
+		}
+		vcd.deleted = append(vcd.deleted, path)
+		writeTestTaskAt(w, r, "ok", "running")
+
+	case r.Method == http.MethodGet && path == "/api/task/ok":
+		writeTestTaskAt(w, r, "ok", "success")
+
+	case r.Method == http.MethodGet && path == "/api/task/failed":
+		writeTestTaskAt(w, r, "failed", "error")
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// writeTestTaskAt answers with the task /api/task/<id> in the given status.
+func writeTestTaskAt(w http.ResponseWriter, r *http.Request, id, status string) {
+	w.Header().Set("Content-Type", types.MimeTask)
+	fmt.Fprintf(w, `<Task xmlns="http://www.vmware.com/vcloud/v1.5" href="http://%s/api/task/%s" status="%s" operation="testing"></Task>`, r.Host, id, status)
+}
+
+// newTestGroup returns an instance group talking to the fake API.
+func (vcd *testVCD) newTestGroup() *InstanceGroup {
+	return &InstanceGroup{
+		Name:      "runners",
+		CacheTTL:  Duration(time.Hour),
+		log:       hclog.NewNullLogger(),
+		vcdClient: vcd.client,
+		resources: &vcdResources{client: vcd.client, resolvedAt: time.Now()},
+	}
+}
+
+func newTestTask(t *testing.T, status string) (govcd.Task, *atomic.Bool) {
+	cancelled := &atomic.Bool{}
+
+	client, serverURL := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/task/1/action/cancel":
+			cancelled.Store(true)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/task/1":
+			writeTestTask(w, r, status)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	task := govcd.NewTask(&client.Client)
+	task.Task.HREF = serverURL + "/api/task/1"
+
+	return *task, cancelled
+}
+
+func TestWaitTask(t *testing.T) {
+	g := &InstanceGroup{log: hclog.NewNullLogger()}
+
+	task, _ := newTestTask(t, "success")
+	require.NoError(t, g.waitTask(context.Background(), task))
+
+	task, _ = newTestTask(t, "error")
+	require.Error(t, g.waitTask(context.Background(), task))
+}
+
+func TestWaitTaskCancelled(t *testing.T) {
+	g := &InstanceGroup{log: hclog.NewNullLogger()}
+
+	task, cancelled := newTestTask(t, "running")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.ErrorIs(t, g.waitTask(ctx, task), context.Canceled)
+	require.True(t, cancelled.Load())
+}
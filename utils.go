@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
+	"sync"
 )
 
 type PrivPub interface {
@@ -71,3 +72,25 @@ func generateVMName(prefix string) (string, error) {
 func boolPointer(value bool) *bool {
 	return &value
 }
+
+// runParallel calls fn n times, with at most parallelism calls running at once.
+func runParallel(n int, parallelism int, fn func(i int)) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
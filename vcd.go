@@ -1,24 +1,33 @@
 package vcd
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
-	"html/template"
-	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vmware/go-vcloud-director/v2/govcd"
 	"github.com/vmware/go-vcloud-director/v2/types/v56"
-	"golang.org/x/crypto/ssh"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
 )
 
-func (g *InstanceGroup) getOrCreateVApp() (*govcd.VApp, error) {
-	vapp, err := g.getVApp()
+const (
+	// maxVMsPerVApp is the maximum number of VMs VCD allows in a single vApp
+	maxVMsPerVApp = 128
+
+	// maxVAppsPerGroup caps the size of the group when every VM has its own vApp
+	maxVAppsPerGroup = 1024
+
+	// metadataGroupKey tags the vApps and VMs created by the plugin with the name of the instance group
+	metadataGroupKey = "fleeting-plugin-vcd.group"
+)
+
+func (g *InstanceGroup) getOrCreateVApp(ctx context.Context, p *Placement) (*govcd.VApp, error) {
+	vapp, err := g.getVApp(ctx, p)
 	if err != nil {
-		vapp, err = g.createVApp()
+		vapp, err = g.createVApp(ctx, p, p.VApp)
 		if err != nil {
 			return nil, err
 		}
@@ -26,15 +35,19 @@ func (g *InstanceGroup) getOrCreateVApp() (*govcd.VApp, error) {
 	return vapp, nil
 }
 
-func (g *InstanceGroup) getVApp() (*govcd.VApp, error) {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
+func (g *InstanceGroup) getVApp(ctx context.Context, p *Placement) (*govcd.VApp, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	client, err := g.getClient()
 	if err != nil {
 		return nil, err
 	}
 
-	if g.vAppHREF != "" { // this is way quicker
+	if href, ok := g.vAppHREFs.Load(p.Name); ok { // this is way quicker
 		vapp := govcd.NewVApp(&client.Client)
-		vapp.VApp.HREF = g.vAppHREF
+		vapp.VApp.HREF = href.(string)
 		err = vapp.Refresh()
 		if err != nil {
 			return nil, err
@@ -42,17 +55,12 @@ func (g *InstanceGroup) getVApp() (*govcd.VApp, error) {
 		return vapp, nil
 	}
 
-	org, err := client.GetOrgByName(g.Org)
-	if err != nil {
-		return nil, err
-	}
-
-	vdc, err := org.GetVDCByName(g.VirtualDatacenter, false)
+	_, resources, err := g.getPlacementResources(p)
 	if err != nil {
 		return nil, err
 	}
 
-	vapp, err := vdc.GetVAppByName(g.VApp, true)
+	vapp, err := resources.VDC().GetVAppByName(p.VApp, true)
 	if err != nil {
 		return nil, err
 	}
@@ -60,66 +68,110 @@ func (g *InstanceGroup) getVApp() (*govcd.VApp, error) {
 	return vapp, nil
 }
 
-func (g *InstanceGroup) createVApp() (*govcd.VApp, error) {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
-	if err != nil {
-		return nil, err
+// getPlacementVApps returns the vApps holding the VMs of this instance group in a placement.
+// With a shared vApp this is just that vApp, otherwise the vApps are discovered
+// by their name prefix and the group metadata set by createVApp.
+// As every vApp is then read on its own, Update lists the VMs with a single query instead.
+func (g *InstanceGroup) getPlacementVApps(ctx context.Context, p *Placement) ([]*govcd.VApp, error) {
+	if !g.VAppPerInstance {
+		vapp, err := g.getVApp(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		return []*govcd.VApp{vapp}, nil
 	}
 
-	org, err := client.GetOrgByName(g.Org)
+	resources, placed, err := g.getPlacementResources(p)
 	if err != nil {
 		return nil, err
 	}
 
-	vdc, err := org.GetVDCByName(g.VirtualDatacenter, false)
+	client := resources.client
+	vdc := placed.VDC()
+
+	queryType := client.Client.GetQueryType(types.QtVapp)
+	filter := fmt.Sprintf("name==%s-*;vdc==%s;metadata:%s==STRING:%s",
+		url.QueryEscape(p.VApp),
+		url.QueryEscape(vdc.Vdc.HREF),
+		metadataGroupKey,
+		url.QueryEscape(g.Name),
+	)
+
+	pages, err := queryAll(ctx, &client.Client, queryType, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	vapp, err := vdc.CreateRawVApp(g.VApp, "vApp createed for GitLab fleeting")
+	vapps := []*govcd.VApp{}
+	for _, page := range pages {
+		records := page.VAppRecord
+		if client.Client.IsSysAdmin {
+			records = page.AdminVAppRecord
+		}
+
+		for _, record := range records {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			vapp := govcd.NewVApp(&client.Client)
+			vapp.VApp.HREF = record.HREF
+			if err := vapp.Refresh(); err != nil {
+				return nil, fmt.Errorf("refreshing vApp %s: %w", record.Name, err)
+			}
+			vapps = append(vapps, vapp)
+		}
+	}
+
+	return vapps, nil
+}
+
+func (g *InstanceGroup) createVApp(ctx context.Context, p *Placement, name string) (*govcd.VApp, error) {
+	_, resources, err := g.getPlacementResources(p)
 	if err != nil {
 		return nil, err
 	}
 
-	network, err := vdc.GetOrgVdcNetworkByName(g.Network, true)
+	vapp, err := resources.VDC().CreateRawVApp(name, "vApp createed for GitLab fleeting")
 	if err != nil {
+		g.forgetResourcesIfNotFound(err)
 		return nil, err
 	}
 
-	_, err = vapp.AddOrgNetwork(&govcd.VappNetworkSettings{}, network.OrgVDCNetwork, false)
-	if err != nil {
+	if err = g.setupVApp(ctx, vapp, resources); err != nil {
+		g.cleanup(ctx, "vApp", vapp.VApp.HREF, g.deleteVApp)
 		return nil, err
 	}
 
 	return vapp, nil
 }
 
-func (g *InstanceGroup) getStorageProfile(storageProfileName string) (*types.Reference, error) {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
+// setupVApp tags a freshly created vApp with the group metadata and connects it to the network.
+func (g *InstanceGroup) setupVApp(ctx context.Context, vapp *govcd.VApp, resources *placementResources) error {
+	task, err := vapp.AddMetadataEntryWithVisibilityAsync(metadataGroupKey, g.Name, types.MetadataStringValue, types.MetadataReadWriteVisibility, false)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	org, err := client.GetOrgByName(g.Org)
-	if err != nil {
-		return nil, err
+	if err = g.waitTask(ctx, task); err != nil {
+		return err
 	}
 
-	vdc, err := org.GetVDCByName(g.VirtualDatacenter, false)
+	task, err = vapp.AddOrgNetworkAsync(&govcd.VappNetworkSettings{}, resources.network, false)
 	if err != nil {
-		return nil, err
+		g.forgetResourcesIfNotFound(err)
+		return err
 	}
 
-	storageProfile, err := vdc.FindStorageProfileReference(storageProfileName)
-	if err != nil {
+	return g.waitTask(ctx, task)
+}
+
+func (g *InstanceGroup) getVM(ctx context.Context, href string) (*govcd.VM, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	return &storageProfile, nil
-}
-
-func (g *InstanceGroup) getVM(href string) (*govcd.VM, error) {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
+	client, err := g.getClient()
 	if err != nil {
 		return nil, err
 	}
@@ -134,36 +186,67 @@ func (g *InstanceGroup) getVM(href string) (*govcd.VM, error) {
 	return vm, nil
 }
 
-func (g *InstanceGroup) deleteVM(href string) error {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
+// deleteInstance removes the VM identified by href, along with its vApp
+// when every VM has its own.
+func (g *InstanceGroup) deleteInstance(ctx context.Context, href string) error {
+	defer g.trackDeleting(href)()
+
+	if !g.VAppPerInstance {
+		return g.deleteVM(ctx, href)
+	}
+
+	vm, err := g.getVM(ctx, href)
 	if err != nil {
 		return err
 	}
 
-	vm := govcd.NewVM(&client.Client)
-	vm.VM.HREF = href
+	vapp, err := vm.GetParentVApp()
+	if err != nil {
+		return err
+	}
 
-	task, err := vm.Undeploy() // we don't care about a hard power-off
+	if err := g.stopVM(ctx, href); err != nil {
+		return err
+	}
+
+	if err := g.deleteVApp(ctx, vapp.VApp.HREF); err != nil {
+		return err
+	}
+
+	g.deleteVMPrivateKey(href)
+
+	return nil
+}
+
+func (g *InstanceGroup) deleteVM(ctx context.Context, href string) error {
+	if err := g.stopVM(ctx, href); err != nil {
+		return err
+	}
+
+	vm, err := g.getVM(ctx, href)
 	if err != nil {
-		// it's fine if the VM is already powered off
-		g.log.Info("unable to undeploy VM, probably because it is already off", "error", err, "vm", vm.VM.Name)
-	} else {
-		err = task.WaitTaskCompletion()
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
-	err = vm.Delete()
+	unlock := g.lockSharedVApp(parentVAppHREF(vm))
+	defer unlock()
+
+	task, err := vm.DeleteAsync()
 	if err != nil {
 		return err
 	}
 
+	if err := g.waitTask(ctx, task); err != nil {
+		return err
+	}
+
+	g.deleteVMPrivateKey(href)
+
 	return nil
 }
 
-func (g *InstanceGroup) deleteVApp(href string) error {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
+func (g *InstanceGroup) deleteVApp(ctx context.Context, href string) error {
+	client, err := g.getClient()
 	if err != nil {
 		return err
 	}
@@ -176,7 +259,7 @@ func (g *InstanceGroup) deleteVApp(href string) error {
 		// it's fine if the VApp is already powered off
 		g.log.Info("unable to undeploy VApp, probably because it is already off", "error", err, "vapp", vapp.VApp.Name)
 	} else {
-		err = task.WaitTaskCompletion()
+		err = g.waitTask(ctx, task)
 		if err != nil {
 			return err
 		}
@@ -187,112 +270,229 @@ func (g *InstanceGroup) deleteVApp(href string) error {
 		return err
 	}
 
-	return task.WaitTaskCompletion()
+	return g.waitTask(ctx, task)
 }
 
-func (g *InstanceGroup) addVMToVApp() (*govcd.VM, error) {
-	vapp, err := g.getVApp()
-	if err != nil {
-		return nil, err
+// Provisioning stages, reported when adding a VM fails
+const (
+	stageCreateVApp    = "create vApp"
+	stageClone         = "clone"
+	stagePlacement     = "placement"
+	stageCustomization = "customization"
+	stageResize        = "resize"
+	stagePowerOn       = "power-on"
+)
+
+// cleanupTimeout bounds the removal of half-provisioned VMs, which runs
+// even when the context of the failed operation has been cancelled.
+const cleanupTimeout = 10 * time.Minute
+
+// provisioningError tells at which stage adding a VM failed.
+type provisioningError struct {
+	stage string
+	err   error
+}
+
+func (e *provisioningError) Error() string {
+	return fmt.Sprintf("%s: %s", e.stage, e.err)
+}
+
+func (e *provisioningError) Unwrap() error {
+	return e.err
+}
+
+func stageError(stage string, err error) error {
+	return &provisioningError{stage: stage, err: err}
+}
+
+// addVM provisions a new VM of the given flavor in a placement, either in its shared vApp or in a vApp
+// of its own. A VM for the warm pool is left powered off. If provisioning fails, whatever was created is removed.
+func (g *InstanceGroup) addVM(ctx context.Context, p *Placement, flavor *Flavor, pooled bool) (*govcd.VM, error) {
+	if !g.VAppPerInstance {
+		vapp, err := g.getOrCreateVApp(ctx, p)
+		if err != nil {
+			return nil, stageError(stageCreateVApp, err)
+		}
+		g.vAppHREFs.Store(p.Name, vapp.VApp.HREF)
+		return g.addVMToVApp(ctx, p, vapp, flavor, pooled)
 	}
 
-	vmName, err := generateVMName(g.VMNamePrefix)
+	vappName, err := generateVMName(p.VApp)
 	if err != nil {
-		return nil, err
+		return nil, stageError(stageCreateVApp, err)
 	}
+	defer g.trackProvisioning(vappName)()
 
-	template, err := g.getVAppTemplate()
+	vapp, err := g.createVApp(ctx, p, vappName)
 	if err != nil {
-		return nil, err
+		return nil, stageError(stageCreateVApp, fmt.Errorf("creating vApp %s: %w", vappName, err))
 	}
 
-	netSection, err := g.getVMNetworkConnectionSection()
+	vm, err := g.addVMToVApp(ctx, p, vapp, flavor, pooled)
 	if err != nil {
+		g.cleanup(ctx, "vApp", vapp.VApp.HREF, g.deleteVApp)
 		return nil, err
 	}
 
-	var storageProfile *types.Reference = nil
-	if g.StorageProfile != "" {
-		storageProfile, err = g.getStorageProfile(g.StorageProfile)
-		if err != nil {
-			return nil, err
-		}
+	return vm, nil
+}
+
+func (g *InstanceGroup) addVMToVApp(ctx context.Context, p *Placement, vapp *govcd.VApp, flavor *Flavor, pooled bool) (*govcd.VM, error) {
+	vmName, err := generateVMName(g.VMNamePrefix)
+	if err != nil {
+		return nil, stageError(stageClone, err)
 	}
+	defer g.trackProvisioning(vmName)()
 
-	// TODO(juanfont): fully use vapp.AddNewVMWithComputePolicy with storage and compute policies
-	task, err := vapp.AddNewVMWithComputePolicy(
-		vmName,
-		template,
-		netSection,     // network
-		storageProfile, // storage
-		nil,            // compute policy
-		true,
-	)
+	groupResources, resources, err := g.getPlacementResources(p)
 	if err != nil {
-		return nil, err
+		return nil, stageError(stageClone, err)
 	}
 
-	if err = task.WaitTaskCompletion(); err != nil {
-		return nil, err
+	flavorResources := resources.flavors[flavor.Name]
+	if flavorResources.err != nil {
+		return nil, stageError(stageClone, fmt.Errorf("%w: %w", errFlavorUnavailable, flavorResources.err))
 	}
 
-	vm, err := vapp.GetVMByName(vmName, true)
+	netSection, err := g.getVMNetworkConnectionSection(p)
 	if err != nil {
-		return nil, err
+		return nil, stageError(stageClone, err)
 	}
 
-	err = g.injectCredentials(vm)
+	unlock := g.lockSharedVApp(vapp.VApp.HREF)
+
+	task, err := g.cloneVM(groupResources.client, vapp, vmName, flavorResources, netSection)
 	if err != nil {
-		return nil, err
+		unlock()
+		g.forgetResourcesIfNotFound(err)
+		return nil, stageError(stageClone, err)
 	}
 
-	// TODO(juanfont): Change this to also get the number of cores per socket
-	err = vm.ChangeCPUAndCoreCount(&g.CPUCount, &g.CPUCount)
+	err = g.waitTask(ctx, task)
+	unlock()
 	if err != nil {
-		return nil, err
+		g.cleanupClone(ctx, vapp, vmName)
+		return nil, stageError(stageClone, err)
 	}
 
-	err = vm.ChangeMemory(g.MemoryMB)
+	vm, err := vapp.GetVMByName(vmName, true)
 	if err != nil {
-		return nil, err
+		g.cleanupClone(ctx, vapp, vmName)
+		return nil, stageError(stageClone, err)
 	}
 
-	task, err = vapp.PowerOn()
+	err = g.setupVM(ctx, vapp, vm, p, flavor, resources, pooled)
 	if err != nil {
+		if !g.VAppPerInstance { // otherwise the whole vApp is removed by addVM
+			g.cleanup(ctx, "VM", vm.VM.HREF, g.deleteVM)
+		}
 		return nil, err
 	}
-	if err = task.WaitTaskCompletion(); err != nil {
-		return nil, err
+
+	return vm, nil
+}
+
+// cleanupClone removes the VM a clone that failed or was cancelled may have left in a shared vApp.
+func (g *InstanceGroup) cleanupClone(ctx context.Context, vapp *govcd.VApp, vmName string) {
+	if g.VAppPerInstance { // the whole vApp is removed by addVM
+		return
+	}
+
+	vm, err := vapp.GetVMByName(vmName, true)
+	if err != nil {
+		if !isNotFound(err) {
+			g.log.Error("looking up half-provisioned VM", "name", vmName, "error", err)
+		}
+		return
 	}
 
-	return vm, err
+	g.cleanup(ctx, "VM", vm.VM.HREF, g.deleteVM)
 }
 
-func (g *InstanceGroup) getVAppTemplate() (govcd.VAppTemplate, error) {
-	client, err := newClient(*g.parsedURL, g.Org, g.Token, false)
+// setupVM tags, places, customizes, resizes and powers on a freshly cloned VM,
+// unless it is for the warm pool, where it waits powered off.
+func (g *InstanceGroup) setupVM(ctx context.Context, vapp *govcd.VApp, vm *govcd.VM, p *Placement, flavor *Flavor, resources *placementResources, pooled bool) error {
+	err := g.tagVM(ctx, vm, p, flavor, pooled)
 	if err != nil {
-		return govcd.VAppTemplate{}, err
+		return stageError(stageClone, fmt.Errorf("tagging VM: %w", err))
 	}
 
-	org, err := client.GetOrgByName(g.Org)
+	if resources.placementPolicy != nil {
+		err = g.applyPlacementPolicy(ctx, vm, resources.flavors[flavor.Name].sizingPolicy, resources.placementPolicy)
+		if err != nil {
+			return stageError(stagePlacement, err)
+		}
+	}
+
+	err = g.injectCredentials(ctx, vm)
 	if err != nil {
-		return govcd.VAppTemplate{}, err
+		return stageError(stageCustomization, err)
+	}
+
+	if flavor.SizingPolicy == "" { // otherwise the sizing policy sets the CPU and memory
+		err = g.resizeVM(ctx, vm, flavor)
+		if err != nil {
+			return stageError(stageResize, err)
+		}
+	}
+
+	if pooled {
+		return nil
+	}
+
+	if err = g.powerOnVM(ctx, vapp, vm); err != nil {
+		return stageError(stagePowerOn, err)
 	}
 
-	catalog, err := org.GetCatalogByName(g.Catalog, true)
+	return nil
+}
+
+// powerOnVM powers on a freshly set up VM. A shared vApp may hold VMs of the warm pool,
+// which must stay powered off, so only the VM itself is powered on there.
+func (g *InstanceGroup) powerOnVM(ctx context.Context, vapp *govcd.VApp, vm *govcd.VM) error {
+	var task govcd.Task
+	var err error
+	if g.VAppPerInstance {
+		task, err = vapp.PowerOn()
+	} else {
+		task, err = vm.PowerOn()
+	}
 	if err != nil {
-		return govcd.VAppTemplate{}, err
+		return err
 	}
 
-	catalogItem, err := catalog.GetCatalogItemByName(g.Template, true)
+	return g.waitTask(ctx, task)
+}
+
+// cleanup removes a half-provisioned VM or vApp, logging instead of
+// returning errors as the provisioning error is the one that matters.
+func (g *InstanceGroup) cleanup(ctx context.Context, kind string, href string, remove func(context.Context, string) error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	g.log.Info("removing half-provisioned "+kind, "href", href)
+	if err := remove(ctx, href); err != nil {
+		g.log.Error("removing half-provisioned "+kind, "href", href, "error", err)
+	}
+}
+
+// resizeVM sets the CPU, memory and their allocation of the VM in a single reconfiguration.
+func (g *InstanceGroup) resizeVM(ctx context.Context, vm *govcd.VM, flavor *Flavor) error {
+	vmSpecSection := vm.VM.VmSpecSection
+	// update treats same values as changes and fails, with no values provided - no changes are made for that section
+	vmSpecSection.DiskSection = nil
+
+	g.applySizing(vmSpecSection, flavor)
+
+	task, err := vm.UpdateVmSpecSectionAsync(vmSpecSection, vm.VM.Description)
 	if err != nil {
-		return govcd.VAppTemplate{}, err
+		return err
 	}
 
-	return catalogItem.GetVAppTemplate()
+	return g.waitTask(ctx, task)
 }
 
-func (g *InstanceGroup) getVMNetworkConnectionSection() (*types.NetworkConnectionSection, error) {
+func (g *InstanceGroup) getVMNetworkConnectionSection(p *Placement) (*types.NetworkConnectionSection, error) {
 	netConn := &types.NetworkConnection{}
 	netSection := &types.NetworkConnectionSection{}
 	netSection.NetworkConnection = append(netSection.NetworkConnection, netConn)
@@ -310,85 +510,118 @@ func (g *InstanceGroup) getVMNetworkConnectionSection() (*types.NetworkConnectio
 	netConn.NetworkConnectionIndex = 0
 	netConn.IsConnected = true
 	netConn.NeedsCustomization = true
-	netConn.Network = g.Network
+	netConn.Network = p.Network
 
 	return netSection, nil
 }
 
-func (g *InstanceGroup) injectCredentials(vm *govcd.VM) error {
-	if !g.settings.UseStaticCredentials {
-		return fmt.Errorf("dynamic credentials are not supported yet")
-	}
+func (g *InstanceGroup) injectCredentials(ctx context.Context, vm *govcd.VM) error {
+	var publicKey string
+	var err error
+
+	switch {
+	case !g.settings.UseStaticCredentials && g.DynamicCredentials == dynamicCredentialsPassword:
+		enableAutoAdminPassword(vm)
+	case !g.settings.UseStaticCredentials:
+		var privateKey []byte
+		privateKey, publicKey, err = generateSSHKeyPair()
+		if err != nil {
+			return err
+		}
+
+		if err = g.storeVMPrivateKey(ctx, vm, privateKey); err != nil {
+			return fmt.Errorf("storing private key: %w", err)
+		}
+	case g.staticPassword.isSet():
+		password, err := g.staticPassword.get()
+		if err != nil {
+			return err
+		}
 
-	if g.settings.Password != "" {
 		vm.VM.GuestCustomizationSection.Enabled = boolPointer(true)
-		vm.VM.GuestCustomizationSection.AdminPassword = g.settings.Password
+		vm.VM.GuestCustomizationSection.AdminPassword = password
 		vm.VM.GuestCustomizationSection.AdminPasswordEnabled = boolPointer(true)
 		vm.VM.GuestCustomizationSection.AdminPasswordAuto = boolPointer(false)
 		vm.VM.GuestCustomizationSection.ResetPasswordRequired = boolPointer(false)
-	} else if g.settings.Key != nil {
-		priv, err := ssh.ParseRawPrivateKey(g.settings.Key)
+	case g.settings.Key != nil:
+		publicKey, err = publicKeyFromPrivate(g.settings.Key)
 		if err != nil {
-			return fmt.Errorf("reading private key: %w", err)
-		}
-		var ok bool
-		var key PrivPub
-		key, ok = priv.(PrivPub)
-		if !ok {
-			return fmt.Errorf("key doesn't export PublicKey()")
+			return err
 		}
+	}
 
-		sshPubKey, err := ssh.NewPublicKey(key.Public())
-		if err != nil {
-			return fmt.Errorf("generating ssh public key: %w", err)
-		}
+	data := guestTemplateData{
+		InstanceName: vm.VM.Name,
+		GroupName:    g.Name,
+		PublicKey:    publicKey,
+		Tags:         g.Tags,
+		EnableWinRM:  isWindows(vm) && g.vmProtocol(vm) == provider.ProtocolWinRM,
+	}
 
-		var customizationScript string
-		if strings.Contains(vm.VM.VmSpecSection.OsType, "windows") {
-			customizationScript = windowsGuestCustomizationScript
-		} else {
-			customizationScript = linuxGuestCustomizationScript
+	if g.userData != nil {
+		if err = g.injectUserData(vm, data); err != nil {
+			return fmt.Errorf("injecting user data: %w", err)
 		}
+	}
 
-		templ := template.Must(template.New("script").Parse(customizationScript))
-		var script bytes.Buffer
-		err = templ.Execute(&script, map[string]string{
-			"PublicKey": strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPubKey))),
-		})
-		if err != nil {
-			return err
-		}
+	scriptData := guestScriptData{
+		guestTemplateData: data,
+		// with user-data, cloud-init takes care of authorizing the key on Linux guests
+		KeyAuthorizedByUserData: g.userData != nil && !isWindows(vm),
+	}
 
-		vm.VM.GuestCustomizationSection.Enabled = boolPointer(true)
-		vm.VM.GuestCustomizationSection.CustomizationScript = script.String()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	script, err := g.renderCustomizationScript(isWindows(vm), scriptData)
+	if err != nil {
+		return err
+	}
 
+	if script != "" {
+		vm.VM.GuestCustomizationSection.Enabled = boolPointer(true)
+		vm.VM.GuestCustomizationSection.CustomizationScript = script
 	}
-	_, err := vm.SetGuestCustomizationSection(vm.VM.GuestCustomizationSection)
+
+	_, err = vm.SetGuestCustomizationSection(vm.VM.GuestCustomizationSection)
 	return err
 }
 
-func newClient(apiURL url.URL, org string, token string, insecure bool) (*govcd.VCDClient, error) {
-	client := &govcd.VCDClient{
-		Client: govcd.Client{
-			VCDHREF:    apiURL,
-			APIVersion: "37.3",
-			Http: http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						InsecureSkipVerify: insecure,
-					},
-					Proxy:               http.ProxyFromEnvironment,
-					TLSHandshakeTimeout: 120 * time.Second,
-				},
-				Timeout: 600 * time.Second,
-			},
-			MaxRetryTimeout: 60,
-		},
-	}
-
-	err := client.SetToken(org, govcd.ApiTokenHeader, token)
-	if err != nil {
-		return nil, fmt.Errorf("unable to authenticate to Org \"%s\": %s", org, err)
-	}
-	return client, nil
+func isWindows(vm *govcd.VM) bool {
+	return strings.Contains(vm.VM.VmSpecSection.OsType, "windows")
+}
+
+// vmProtocol returns the protocol used to connect to the VM, resolving "auto" to WinRM
+// for Windows guests and SSH for everything else. As WinRM needs a password, Windows
+// guests are connected to over SSH too when the credentials are keys.
+func (g *InstanceGroup) vmProtocol(vm *govcd.VM) provider.Protocol {
+	if g.Protocol != protocolAuto {
+		return provider.Protocol(g.Protocol)
+	}
+
+	if isWindows(vm) && g.hasPasswordCredentials() {
+		return provider.ProtocolWinRM
+	}
+	return provider.ProtocolSSH
+}
+
+// lockSharedVApp serializes the changes to a shared vApp, which VCD locks while
+// adding or removing a VM. It does nothing when every VM has its own vApp.
+func (g *InstanceGroup) lockSharedVApp(href string) func() {
+	if g.VAppPerInstance {
+		return func() {}
+	}
+
+	mu, _ := g.sharedVAppMu.LoadOrStore(href, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// parentVAppHREF returns the HREF of the vApp holding a VM.
+func parentVAppHREF(vm *govcd.VM) string {
+	if link := vm.VM.Link.ForType(types.MimeVApp, "up"); link != nil {
+		return link.HREF
+	}
+	return ""
 }
@@ -0,0 +1,25 @@
+package vcd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCancelled(t *testing.T) {
+	vcd := newTestVCD(t)
+	vcd.addVM("/api/vApp/vm-1", "/api/vApp/vapp-1", map[string]string{})
+
+	g := vcd.newTestGroup()
+	g.vAppHREFs.Store("default", vcd.serverURL+"/api/vApp/vapp-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := g.getVM(ctx, vcd.serverURL+"/api/vApp/vm-1")
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = g.getVApp(ctx, &Placement{Name: "default", VApp: "vapp-1"})
+	require.ErrorIs(t, err, context.Canceled)
+}